@@ -0,0 +1,346 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const adminPrefix = "/web-composer/"
+
+func init() {
+	caddy.RegisterModule(adminWebComposer{})
+}
+
+// composers holds the provisioned handlers, so the admin API can reach
+// their caches.
+var composers = struct {
+	mutex     sync.RWMutex
+	instances map[*WebComposer]struct{}
+}{instances: make(map[*WebComposer]struct{})}
+
+// adminWebComposer is a module that provides the /web-composer/
+// endpoints of the Caddy admin API, to inspect and manage the cache of
+// the web-composer handlers at runtime.
+type adminWebComposer struct{}
+
+type cacheEntryStatus struct {
+	Id          string     `json:"id"`
+	Method      string     `json:"method"`
+	Url         string     `json:"url"`
+	Status      int        `json:"status"`
+	Size        int        `json:"size"`
+	CachedUntil *time.Time `json:"cached_until,omitempty"`
+	Hits        int64      `json:"hits"`
+	Tags        []string   `json:"tags,omitempty"`
+}
+
+type purgeRequest struct {
+	Ids       []string `json:"ids,omitempty"`
+	UrlPrefix string   `json:"url_prefix,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (adminWebComposer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.web_composer",
+		New: func() caddy.Module { return new(adminWebComposer) },
+	}
+}
+
+// Routes returns the routes of the /web-composer/ endpoints.
+func (a adminWebComposer) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminPrefix,
+			Handler: caddy.AdminHandlerFunc(a.handle),
+		},
+	}
+}
+
+// handle dispatches the requests:
+//
+//	GET    /web-composer/cache              list the cached sources
+//	GET    /web-composer/cache/<id>         raw content of a source
+//	DELETE /web-composer/cache/<id>         purge a source
+//	POST   /web-composer/cache/<id>/refresh fetch a source again
+//	POST   /web-composer/purge              purge by ids, url prefix or tags
+//	POST   /web-composer/flush              purge everything
+func (a adminWebComposer) handle(w http.ResponseWriter, r *http.Request) error {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "cache" && r.Method == http.MethodGet:
+		return a.handleList(w)
+	case len(parts) == 2 && parts[0] == "cache" && r.Method == http.MethodGet:
+		return a.handleContent(w, parts[1])
+	case len(parts) == 2 && parts[0] == "cache" && r.Method == http.MethodDelete:
+		return a.handlePurge(w, purgeRequest{Ids: []string{parts[1]}})
+	case len(parts) == 3 && parts[0] == "cache" && parts[2] == "refresh" && r.Method == http.MethodPost:
+		return a.handleRefresh(w, r, parts[1])
+	case path == "purge" && r.Method == http.MethodPost:
+		request := purgeRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+
+		return a.handlePurge(w, request)
+	case path == "flush" && r.Method == http.MethodPost:
+		return a.handleFlush(w)
+	case path == "cache" || path == "purge" || path == "flush" || (len(parts) > 1 && parts[0] == "cache"):
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        errors.New("method not allowed"),
+		}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.Errorf("unknown endpoint %s", r.URL.Path),
+		}
+	}
+}
+
+func (a adminWebComposer) handleList(w http.ResponseWriter) error {
+	results := []cacheEntryStatus{}
+
+	for _, cache := range registeredCaches() {
+		for _, entry := range cache.snapshot() {
+			results = append(results, entry.status())
+		}
+	}
+
+	return writeJson(w, results)
+}
+
+func (a adminWebComposer) handleContent(w http.ResponseWriter, id string) error {
+	entry, _ := findCacheEntry(id)
+
+	if entry == nil {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.Errorf("source %s not cached", id)}
+	}
+
+	source := entry.source
+
+	if source.responseHeaders != nil && source.responseHeaders.Get("Content-Type") != "" {
+		w.Header().Set("Content-Type", source.responseHeaders.Get("Content-Type"))
+	}
+
+	_, err := w.Write([]byte(stringOrEmpty(source.responseContent)))
+	return err
+}
+
+func (a adminWebComposer) handlePurge(w http.ResponseWriter, request purgeRequest) error {
+	result := purgeResult{}
+
+	for _, cache := range registeredCaches() {
+		for _, id := range request.Ids {
+			if cache.delete(id) {
+				result.Purged++
+			}
+		}
+
+		for _, tag := range request.Tags {
+			result.Purged += cache.purgeTag(tag)
+		}
+
+		if request.UrlPrefix != "" {
+			result.Purged += cache.purgeUrlPrefix(request.UrlPrefix)
+		}
+	}
+
+	return writeJson(w, result)
+}
+
+func (a adminWebComposer) handleFlush(w http.ResponseWriter) error {
+	result := purgeResult{}
+
+	for _, cache := range registeredCaches() {
+		result.Purged += cache.flush()
+	}
+
+	return writeJson(w, result)
+}
+
+func (a adminWebComposer) handleRefresh(w http.ResponseWriter, r *http.Request, id string) error {
+	entry, composer := findCacheEntry(id)
+
+	if entry == nil {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.Errorf("source %s not cached", id)}
+	}
+
+	source, err := composer.refresh(r.Context(), entry.source)
+
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+	}
+
+	return writeJson(w, composer.cache.entryStatus(source))
+}
+
+func (e *CacheEntry) status() cacheEntryStatus {
+	result := cacheEntryStatus{}
+	result.Id = stringOrEmpty(e.source.id)
+	result.Method = stringOrEmpty(e.source.method)
+	result.Url = stringOrEmpty(e.source.url)
+	result.Size = len(stringOrEmpty(e.source.responseContent))
+	result.CachedUntil = e.validUntil
+	result.Hits = atomic.LoadInt64(&e.hits)
+	result.Tags = e.tags
+
+	if e.source.responseStatusCode != nil {
+		result.Status = *e.source.responseStatusCode
+	}
+
+	return result
+}
+
+func (c *Cache) entryStatus(source *WebSource) *cacheEntryStatus {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	entry := c.entries[*source.id]
+
+	if entry == nil {
+		return nil
+	}
+
+	status := entry.status()
+	return &status
+}
+
+// refresh fetches the source again outside of any page request and stores
+// the new response in the cache.
+func (w *WebComposer) refresh(ctx context.Context, cached *WebSource) (*WebSource, error) {
+	if cached.dependsOnRequest() {
+		return nil, errors.New("source depends on the page request, it cannot be refreshed in background")
+	}
+
+	service, err := w.findService(cached.url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	source := newSource(cached.method, cached.url, cached.body)
+	source.service = service
+
+	composeContext, err := w.createBackgroundContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer composeContext.close()
+
+	err = source.load(*composeContext)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if source.cachedUntil == nil {
+		w.cache.delete(*source.id)
+	} else {
+		w.cache.set(source, source.cachedUntil)
+	}
+
+	return source, nil
+}
+
+// createBackgroundContext returns a context able to load sources without
+// a page request, so no header of the user is forwarded.
+func (w *WebComposer) createBackgroundContext(ctx context.Context) (*ComposeContext, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return w.createContext(request, nil), nil
+}
+
+func (w *WebComposer) register() {
+	composers.mutex.Lock()
+	defer composers.mutex.Unlock()
+
+	composers.instances[w] = struct{}{}
+}
+
+func (w *WebComposer) unregister() {
+	composers.mutex.Lock()
+	defer composers.mutex.Unlock()
+
+	delete(composers.instances, w)
+}
+
+// registeredCaches returns the caches of the provisioned handlers, once
+// even if several handlers share it.
+func registeredCaches() []*Cache {
+	composers.mutex.RLock()
+	defer composers.mutex.RUnlock()
+
+	var result []*Cache
+
+	for composer := range composers.instances {
+		if composer.cache != nil && !containsCache(result, composer.cache) {
+			result = append(result, composer.cache)
+		}
+	}
+
+	return result
+}
+
+func containsCache(caches []*Cache, cache *Cache) bool {
+	for _, candidate := range caches {
+		if candidate == cache {
+			return true
+		}
+	}
+	return false
+}
+
+func findCacheEntry(id string) (*CacheEntry, *WebComposer) {
+	composers.mutex.RLock()
+	defer composers.mutex.RUnlock()
+
+	for composer := range composers.instances {
+		if composer.cache == nil {
+			continue
+		}
+
+		entry := composer.cache.entry(id)
+
+		if entry != nil {
+			return entry, composer
+		}
+	}
+
+	return nil, nil
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(value)
+}
+
+func stringOrEmpty(input *string) string {
+	if input != nil {
+		return *input
+	}
+	return ""
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminWebComposer)(nil)
+)
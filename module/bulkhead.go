@@ -0,0 +1,150 @@
+package module
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var errBulkheadFull = errors.New("Service maximum in flight requests reached")
+var errRateLimited = errors.New("Service rate limit reached")
+
+type RateLimit struct {
+	// Requests per second allowed to the service.
+	Rate float64 `json:"rate,omitempty"`
+
+	// Requests allowed in a burst above the rate, 1 when zero.
+	Burst int `json:"burst,omitempty"`
+}
+
+type bulkhead struct {
+	slots chan struct{}
+}
+
+type tokenBucket struct {
+	mutex    sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newBulkhead(maxInFlight int) *bulkhead {
+	result := new(bulkhead)
+	result.slots = make(chan struct{}, maxInFlight)
+	return result
+}
+
+// acquire takes a slot of the bulkhead, waiting up to timeout for one to
+// be released.
+func (b *bulkhead) acquire(ctx context.Context, timeout time.Duration) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if timeout <= 0 {
+		return errBulkheadFull
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errBulkheadFull
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+func (r *RateLimit) provision() error {
+	if r.Rate <= 0 {
+		return errors.Errorf("Rate limit %f must be positive", r.Rate)
+	}
+
+	if r.Burst <= 0 {
+		r.Burst = 1
+	}
+
+	return nil
+}
+
+func newTokenBucket(config *RateLimit) *tokenBucket {
+	result := new(tokenBucket)
+	result.rate = config.Rate
+	result.burst = float64(config.Burst)
+	result.tokens = result.burst
+	result.lastFill = time.Now()
+	return result
+}
+
+// take consumes a token, waiting up to timeout for the bucket to refill.
+func (t *tokenBucket) take(ctx context.Context, timeout time.Duration) error {
+	t.mutex.Lock()
+
+	now := time.Now()
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.lastFill).Seconds()*t.rate)
+	t.lastFill = now
+
+	if t.tokens >= 1 {
+		t.tokens--
+		t.mutex.Unlock()
+		return nil
+	}
+
+	wait := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+
+	if wait > timeout {
+		t.mutex.Unlock()
+		return errRateLimited
+	}
+
+	t.tokens--
+	t.mutex.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// admit applies the rate limit and the bulkhead of the service to a
+// request. The returned function releases the bulkhead slot.
+func (s *Service) admit(ctx context.Context) (func(), error) {
+	timeout := time.Duration(s.QueueTimeout)
+
+	if s.limiter != nil {
+		err := s.limiter.take(ctx, timeout)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.bulkhead == nil {
+		return func() {}, nil
+	}
+
+	err := s.bulkhead.acquire(ctx, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.bulkhead.release, nil
+}
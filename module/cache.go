@@ -1,47 +1,502 @@
 package module
 
 import (
+	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const defaultCacheName = "default"
+
+// caches keeps the global caches alive across config reloads, shared by
+// the handlers using the same cache name.
+var caches = caddy.NewUsagePool()
+
 type Cache struct {
-	entries map[string]*CacheEntry
-	logger  *zap.Logger
+	name       string
+	mutex      sync.RWMutex
+	entries    map[string]*CacheEntry
+	logger     *zap.Logger
+	listeners  []*cacheListener
+	tags       map[string]map[string]struct{}
+	varies     map[string][]string
+	missing    map[string]time.Time
+	store      *diskStore
+	diskConfig *DiskCache
+	services   func(rawUrl *string) (*Service, error)
+	limits     *MemoryCache
+	bytes      int64
+	stop       chan struct{}
+}
+
+type cacheListener struct {
+	notify func(id string)
 }
 
 type CacheEntry struct {
 	source     *WebSource
 	validUntil *time.Time
+	tags       []string
+	hits       int64
+	lastUsed   int64
 }
 
 func (w *WebComposer) createCache() *Cache {
 	cache := new(Cache)
 	cache.logger = w.logger
 	cache.entries = make(map[string]*CacheEntry)
+	cache.tags = make(map[string]map[string]struct{})
+	cache.varies = make(map[string][]string)
+	cache.missing = make(map[string]time.Time)
+	cache.services = w.findService
 	return cache
 }
 
-func (c Cache) get(id *string) (*WebSource, *time.Time) {
-	entry := c.entries[*id]
+// loadCache returns the global cache of the handler name, creating it if no
+// other handler uses it. The disk tier and bounds of the last provisioned
+// handler are applied.
+func (w *WebComposer) loadCache() (*Cache, error) {
+	value, loaded, err := caches.LoadOrNew(w.CacheName, func() (caddy.Destructor, error) {
+		cache := w.createCache()
+		cache.name = w.CacheName
+		cache.limits = w.MemoryCache
+
+		if w.DiskCache != nil {
+			store, err := openDiskStore(w.DiskCache, w.logger)
+
+			if err != nil {
+				return nil, err
+			}
+
+			cache.store = store
+			cache.diskConfig = w.DiskCache
+		}
+
+		cache.startSweeper()
+		return cache, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	cache := value.(*Cache)
+
+	if loaded {
+		w.logger.Info("Reusing Web-Composer cache", zap.String("cache", w.CacheName))
+		err = cache.reconfigure(w)
+
+		if err != nil {
+			_, _ = caches.Delete(w.CacheName)
+			return nil, err
+		}
+	}
+
+	return cache, nil
+}
+
+// Destruct implements caddy.Destructor.
+func (c *Cache) Destruct() error {
+	c.stopSweeper()
+	composerMetrics.cacheEntries.DeleteLabelValues(c.name)
+	composerMetrics.cacheSize.DeleteLabelValues(c.name)
+
+	if c.store != nil {
+		return closeDiskStore(c.diskConfig)
+	}
+	return nil
+}
+
+func (c *Cache) disk() *diskStore {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.store
+}
+
+// reconfigure applies the disk tier and the bounds of a handler reusing the
+// cache, so a config reload changing them is not ignored.
+func (c *Cache) reconfigure(w *WebComposer) error {
+	c.mutex.Lock()
+	c.limits = w.MemoryCache
+	c.services = w.findService
+	previous := c.diskConfig
+
+	if sameDiskCache(previous, w.DiskCache) {
+		c.diskConfig = w.DiskCache
+		c.mutex.Unlock()
+		return nil
+	}
+
+	c.mutex.Unlock()
+
+	var store *diskStore
+
+	if w.DiskCache != nil {
+		var err error
+		store, err = openDiskStore(w.DiskCache, w.logger)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	w.logger.Warn(
+		"Web-Composer cache disk tier changed",
+		zap.String("cache", c.name),
+		zap.String("previous", diskCachePath(previous)),
+		zap.String("current", diskCachePath(w.DiskCache)),
+	)
+
+	c.mutex.Lock()
+	c.store = store
+	c.diskConfig = w.DiskCache
+	c.mutex.Unlock()
+
+	if previous != nil {
+		return closeDiskStore(previous)
+	}
+	return nil
+}
+
+func (c *Cache) get(id *string) (*WebSource, *time.Time) {
+	entry := c.entry(*id)
 
 	if entry != nil {
+		entry.touch()
+
 		if entry.validUntil != nil {
 			if entry.validUntil.After(time.Now()) {
+				atomic.AddInt64(&entry.hits, 1)
 				return entry.source, entry.validUntil
 			} else {
 				return nil, nil
 			}
 		} else {
+			atomic.AddInt64(&entry.hits, 1)
 			return entry.source, entry.validUntil
 		}
 	}
 	return nil, nil
 }
 
-func (c Cache) set(source *WebSource, validUntil *time.Time) {
+// getStale returns the entry even when it is no longer valid, used as
+// fallback when the source cannot be loaded.
+func (c *Cache) getStale(id *string) (*WebSource, *time.Time) {
+	entry := c.entry(*id)
+
+	if entry != nil {
+		entry.touch()
+		return entry.source, entry.validUntil
+	}
+	return nil, nil
+}
+
+// entry returns the entry of the id, loading it from the disk store on a
+// memory miss with the service of its url.
+func (c *Cache) entry(id string) *CacheEntry {
+	c.mutex.RLock()
+	entry := c.entries[id]
+	store := c.store
+	services := c.services
+	c.mutex.RUnlock()
+
+	if entry != nil || store == nil {
+		return entry
+	}
+
+	source, validUntil := store.get(id)
+
+	if source == nil {
+		return nil
+	}
+
+	// the service is not stored, the one of the current config is used and
+	// none when it was removed
+	source.service, _ = services(source.url)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry = c.entries[id]
+
+	if entry == nil {
+		entry = newCacheEntry(source, validUntil)
+		c.entries[id] = entry
+		c.tag(id, entry)
+		c.account(entry, 1)
+		c.enforceLimits()
+	}
+
+	return entry
+}
+
+func newCacheEntry(source *WebSource, validUntil *time.Time) *CacheEntry {
 	entry := new(CacheEntry)
+	entry.lastUsed = time.Now().UnixNano()
 	entry.source = source
 	entry.validUntil = validUntil
+	entry.tags = source.tags()
+	return entry
+}
+
+// set stores the source and notifies the listeners of the new content.
+func (c *Cache) set(source *WebSource, validUntil *time.Time) {
+	c.mutex.Lock()
+
+	entry := newCacheEntry(source, validUntil)
+	previous, refreshed := c.entries[*source.id]
+
+	if refreshed {
+		c.untag(*source.id, previous)
+		c.account(previous, -1)
+	}
+
+	c.forgetMissing(*source.id)
+
 	c.entries[*source.id] = entry
+	c.tag(*source.id, entry)
+	c.account(entry, 1)
+	c.enforceLimits()
+	listeners := c.listeners
+	store := c.store
+
+	c.mutex.Unlock()
+
+	if store != nil && validUntil != nil {
+		store.put(source, validUntil)
+	}
+
+	// the pages may depend on an entry evicted from memory since, so the
+	// listeners hear of every store and not only of the replaced entries
+	notifyListeners(listeners, *source.id)
+}
+
+// extend keeps the entry in memory until the time, without notifying the
+// listeners as the content did not change.
+func (c *Cache) extend(id string, validUntil *time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	previous := c.entries[id]
+
+	if previous == nil {
+		return
+	}
+
+	entry := newCacheEntry(previous.source, validUntil)
+	entry.hits = atomic.LoadInt64(&previous.hits)
+	c.entries[id] = entry
+}
+
+func (c *Cache) delete(id string) bool {
+	c.mutex.Lock()
+
+	entry, found := c.entries[id]
+
+	if found {
+		c.untag(id, entry)
+		c.account(entry, -1)
+		delete(c.entries, id)
+	}
+
+	c.forgetMissing(id)
+
+	listeners := c.listeners
+	store := c.store
+
+	c.mutex.Unlock()
+
+	if store != nil && store.delete(id) {
+		found = true
+	}
+
+	if found {
+		c.countEviction()
+		notifyListeners(listeners, id)
+	}
+
+	return found
+}
+
+// purgeTag deletes every entry whose response was tagged with the tag,
+// returning how many were deleted.
+func (c *Cache) purgeTag(tag string) int {
+	c.mutex.RLock()
+	ids := make([]string, 0, len(c.tags[tag]))
+
+	for id := range c.tags[tag] {
+		ids = append(ids, id)
+	}
+
+	store := c.store
+	c.mutex.RUnlock()
+
+	if store != nil {
+		for _, id := range store.idsWithTag(tag) {
+			if !containsString(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	purged := 0
+
+	for _, id := range ids {
+		if c.delete(id) {
+			purged++
+		}
+	}
+
+	return purged
+}
+
+// purgeUrlPrefix deletes the sources whose url starts with the prefix, in
+// memory and on disk.
+func (c *Cache) purgeUrlPrefix(prefix string) int {
+	var ids []string
+
+	for _, entry := range c.snapshot() {
+		if strings.HasPrefix(stringOrEmpty(entry.source.url), prefix) {
+			ids = append(ids, *entry.source.id)
+		}
+	}
+
+	if store := c.disk(); store != nil {
+		for _, id := range store.idsWithUrlPrefix(prefix) {
+			if !containsString(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	purged := 0
+
+	for _, id := range ids {
+		if c.delete(id) {
+			purged++
+		}
+	}
+
+	return purged
+}
+
+func (c *Cache) tag(id string, entry *CacheEntry) {
+	for _, tag := range entry.tags {
+		ids := c.tags[tag]
+
+		if ids == nil {
+			ids = make(map[string]struct{})
+			c.tags[tag] = ids
+		}
+
+		ids[id] = struct{}{}
+	}
+}
+
+func (c *Cache) untag(id string, entry *CacheEntry) {
+	for _, tag := range entry.tags {
+		ids := c.tags[tag]
+		delete(ids, id)
+
+		if len(ids) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
+
+// subscribe registers a function called with the id of every entry that
+// is stored or deleted. The returned function unregisters it.
+func (c *Cache) subscribe(notify func(id string)) func() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	listener := &cacheListener{notify: notify}
+	c.listeners = append(c.listeners, listener)
+
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		for i, candidate := range c.listeners {
+			if candidate == listener {
+				c.listeners = append(c.listeners[:i:i], c.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func notifyListeners(listeners []*cacheListener, id string) {
+	for _, listener := range listeners {
+		listener.notify(id)
+	}
+}
+
+// snapshot returns a copy of the entries, safe to read without the lock.
+func (c *Cache) snapshot() []*CacheEntry {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	result := make([]*CacheEntry, 0, len(c.entries))
+
+	for _, entry := range c.entries {
+		result = append(result, entry)
+	}
+
+	return result
+}
+
+func (c *Cache) flush() int {
+	var ids []string
+
+	for _, entry := range c.snapshot() {
+		ids = append(ids, *entry.source.id)
+	}
+
+	if store := c.disk(); store != nil {
+		for _, id := range store.ids() {
+			if !containsString(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	flushed := 0
+
+	for _, id := range ids {
+		if c.delete(id) {
+			flushed++
+		}
+	}
+
+	return flushed
+}
+
+// account updates the size metrics with an entry added, sign 1, or removed,
+// sign -1. Only the global caches, which have a name, report them.
+func (c *Cache) account(entry *CacheEntry, sign float64) {
+	c.bytes += int64(sign) * int64(len(stringOrEmpty(entry.source.responseContent)))
+
+	if c.name == "" {
+		return
+	}
+
+	composerMetrics.cacheEntries.WithLabelValues(c.name).Add(sign)
+	composerMetrics.cacheSize.WithLabelValues(c.name).Add(sign * float64(len(stringOrEmpty(entry.source.responseContent))))
+}
+
+func (c *Cache) countEviction() {
+	if c.name != "" {
+		composerMetrics.cacheEvictions.WithLabelValues(c.name).Inc()
+	}
+}
+
+func (c *Cache) countLookup(result string) {
+	if c.name != "" {
+		composerMetrics.cacheLookups.WithLabelValues(c.name, result).Inc()
+	}
 }
@@ -0,0 +1,236 @@
+package module
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	result := make(cacheControl)
+
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+
+			if directive == "" {
+				continue
+			}
+
+			name, argument, _ := strings.Cut(directive, "=")
+			result[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(argument), `"`)
+		}
+	}
+
+	return result
+}
+
+func (c cacheControl) has(name string) bool {
+	_, found := c[name]
+	return found
+}
+
+func (c cacheControl) seconds(name string) (int, bool) {
+	value, found := c[name]
+
+	if !found {
+		return 0, false
+	}
+
+	number, err := strconv.Atoi(value)
+
+	if err != nil || number < 0 {
+		return 0, false
+	}
+
+	return number, true
+}
+
+// storable reports whether a shared cache, like the global one, can keep
+// the response.
+func (c cacheControl) storable() bool {
+	return !c.has("no-store") && !c.has("no-cache") && !c.has("private")
+}
+
+func (c cacheControl) String() string {
+	names := make([]string, 0, len(c))
+
+	for name := range c {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	directives := make([]string, 0, len(names))
+
+	for _, name := range names {
+		if c[name] != "" {
+			directives = append(directives, name+"="+c[name])
+		} else {
+			directives = append(directives, name)
+		}
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// mergeCacheControl sets the page Cache-Control to the most restrictive
+// combination of the page and the components ones, so a personalised
+// component is never cached downstream as part of a public page. The
+// components without Cache-Control do not restrict the page.
+func mergeCacheControl(page http.Header, sources map[string]*WebSource) {
+	if len(sources) == 0 {
+		return
+	}
+
+	result := parseCacheControl(page)
+	maxAge, hasMaxAge := result.seconds("max-age")
+	sharedMaxAge, hasSharedMaxAge := result.seconds("s-maxage")
+	sharedKnown := hasSharedMaxAge
+
+	if !sharedKnown && hasMaxAge {
+		sharedMaxAge = maxAge
+		sharedKnown = true
+	}
+
+	constrained := false
+
+	for _, source := range sources {
+		if source.responseHeaders == nil || len(source.responseHeaders.Values("Cache-Control")) == 0 {
+			continue
+		}
+
+		constrained = true
+		component := parseCacheControl(*source.responseHeaders)
+
+		for _, name := range []string{"no-store", "no-cache", "private", "must-revalidate", "proxy-revalidate"} {
+			if component.has(name) {
+				result[name] = ""
+			}
+		}
+
+		componentMaxAge, found := component.seconds("max-age")
+
+		if found {
+			componentMaxAge = source.remainingSeconds(componentMaxAge)
+
+			if !hasMaxAge || componentMaxAge < maxAge {
+				maxAge = componentMaxAge
+				hasMaxAge = true
+			}
+		}
+
+		componentSharedMaxAge, found := component.seconds("s-maxage")
+
+		if !found {
+			componentSharedMaxAge, found = component.seconds("max-age")
+		}
+
+		if found {
+			componentSharedMaxAge = source.remainingSeconds(componentSharedMaxAge)
+
+			if !sharedKnown || componentSharedMaxAge < sharedMaxAge {
+				sharedMaxAge = componentSharedMaxAge
+				sharedKnown = true
+			}
+		}
+	}
+
+	if !constrained {
+		return
+	}
+
+	if hasMaxAge {
+		result["max-age"] = strconv.Itoa(maxAge)
+	}
+
+	if hasSharedMaxAge || (sharedKnown && (!hasMaxAge || sharedMaxAge < maxAge)) {
+		result["s-maxage"] = strconv.Itoa(sharedMaxAge)
+	}
+
+	if result.has("private") || result.has("no-store") {
+		delete(result, "public")
+		delete(result, "s-maxage")
+	}
+
+	if result.has("no-store") {
+		delete(result, "max-age")
+	}
+
+	page.Set("Cache-Control", result.String())
+	page.Del("Expires")
+}
+
+// restrictCacheControl marks the page as not storable, used when its
+// headers are sent before the components say how they can be cached.
+func restrictCacheControl(page http.Header) {
+	result := parseCacheControl(page)
+	delete(result, "public")
+	delete(result, "max-age")
+	delete(result, "s-maxage")
+	result["private"] = ""
+	result["no-store"] = ""
+
+	page.Set("Cache-Control", result.String())
+	page.Del("Expires")
+}
+
+// remainingSeconds reduces the max-age of a cached source by the time it
+// has already spent in the cache.
+func (s *WebSource) remainingSeconds(maxAge int) int {
+	if s.cachedUntil == nil {
+		return maxAge
+	}
+
+	remaining := int(time.Until(*s.cachedUntil).Seconds())
+
+	if remaining < 0 {
+		return 0
+	}
+
+	if remaining < maxAge {
+		return remaining
+	}
+
+	return maxAge
+}
+
+// mergeVary adds the Vary headers of the components to the page one.
+func mergeVary(page http.Header, sources map[string]*WebSource) {
+	var names []string
+
+	add := func(values []string) {
+		for _, value := range values {
+			for _, name := range strings.Split(value, ",") {
+				name = strings.TrimSpace(name)
+
+				if name != "" && !containsHeaderName(names, name) {
+					names = append(names, http.CanonicalHeaderKey(name))
+				}
+			}
+		}
+	}
+
+	add(page.Values("Vary"))
+	pageNames := len(names)
+
+	for _, source := range sources {
+		if source.responseHeaders != nil {
+			add(source.responseHeaders.Values("Vary"))
+		}
+	}
+
+	if len(names) == pageNames {
+		return
+	}
+
+	if containsString(names, "*") {
+		page.Set("Vary", "*")
+	} else {
+		page.Set("Vary", strings.Join(names, ", "))
+	}
+}
@@ -0,0 +1,141 @@
+package module
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func cacheControlSources(values []string) map[string]*WebSource {
+	result := make(map[string]*WebSource)
+
+	for i, value := range values {
+		header := make(http.Header)
+
+		if value != "" {
+			header.Set("Cache-Control", value)
+		}
+
+		source := new(WebSource)
+		source.responseHeaders = &header
+		result[strconv.Itoa(i)] = source
+	}
+
+	return result
+}
+
+func TestMergeCacheControl(t *testing.T) {
+	tests := []struct {
+		name       string
+		page       string
+		components []string
+		expected   string
+		expires    bool
+	}{
+		{"no components", "public, max-age=600", nil, "public, max-age=600", true},
+		{"components without cache control", "public, max-age=600", []string{""}, "public, max-age=600", true},
+		{"shorter component max-age", "public, max-age=600", []string{"max-age=60"}, "max-age=60, public", false},
+		{"longer component max-age", "public, max-age=60", []string{"max-age=600"}, "max-age=60, public", false},
+		{"shortest of the components", "max-age=600", []string{"max-age=120", "max-age=30, must-revalidate"}, "max-age=30, must-revalidate", false},
+		{"private component", "public, max-age=600, s-maxage=600", []string{"private, max-age=60"}, "max-age=60, private", false},
+		{"no-store component", "public, max-age=600", []string{"no-store"}, "no-store", false},
+		{"no-cache component", "public, max-age=600", []string{"no-cache"}, "max-age=600, no-cache, public", false},
+		{"component s-maxage", "public, max-age=600", []string{"public, s-maxage=30, max-age=300"}, "max-age=300, public, s-maxage=30", false},
+		{"page s-maxage kept", "public, max-age=600, s-maxage=60", []string{"max-age=300"}, "max-age=300, public, s-maxage=60", false},
+		{"page without cache control", "", []string{"max-age=60"}, "max-age=60", false},
+		{"invalid component max-age", "public, max-age=600", []string{"max-age=soon"}, "max-age=600, public", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := make(http.Header)
+
+			if test.page != "" {
+				page.Set("Cache-Control", test.page)
+			}
+
+			page.Set("Expires", "Thu, 01 Jan 2099 00:00:00 GMT")
+			mergeCacheControl(page, cacheControlSources(test.components))
+
+			if got := page.Get("Cache-Control"); got != test.expected {
+				t.Errorf("Cache-Control %q, expected %q", got, test.expected)
+			}
+
+			if expires := page.Get("Expires") != ""; expires != test.expires {
+				t.Errorf("Expires kept %v, expected %v", expires, test.expires)
+			}
+		})
+	}
+}
+
+// The max-age of a cached component is reduced by the time it has been
+// cached, so the page does not outlive it downstream.
+func TestMergeCacheControlRemainingTime(t *testing.T) {
+	sources := cacheControlSources([]string{"max-age=60"})
+	cachedUntil := time.Now().Add(30*time.Second + 500*time.Millisecond)
+	sources["0"].cachedUntil = &cachedUntil
+
+	page := make(http.Header)
+	page.Set("Cache-Control", "public, max-age=600")
+	mergeCacheControl(page, sources)
+
+	if got := page.Get("Cache-Control"); got != "max-age=30, public" {
+		t.Errorf("Cache-Control %q, expected %q", got, "max-age=30, public")
+	}
+}
+
+func TestRestrictCacheControl(t *testing.T) {
+	page := make(http.Header)
+	page.Set("Cache-Control", "public, max-age=600, s-maxage=60, must-revalidate")
+	page.Set("Expires", "Thu, 01 Jan 2099 00:00:00 GMT")
+	restrictCacheControl(page)
+
+	if got := page.Get("Cache-Control"); got != "must-revalidate, no-store, private" {
+		t.Errorf("Cache-Control %q, expected %q", got, "must-revalidate, no-store, private")
+	}
+
+	if page.Get("Expires") != "" {
+		t.Error("Expires kept")
+	}
+}
+
+func TestMergeVary(t *testing.T) {
+	tests := []struct {
+		name       string
+		page       string
+		components []string
+		expected   string
+	}{
+		{"no component vary", "Accept-Encoding", []string{""}, "Accept-Encoding"},
+		{"component vary added", "Accept-Encoding", []string{"accept-language"}, "Accept-Encoding, Accept-Language"},
+		{"duplicates once", "Accept-Language", []string{"Accept-Language, Cookie", "cookie"}, "Accept-Language, Cookie"},
+		{"vary all", "Accept-Encoding", []string{"*"}, "*"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := make(http.Header)
+			page.Set("Vary", test.page)
+			sources := make(map[string]*WebSource)
+
+			for i, value := range test.components {
+				header := make(http.Header)
+
+				if value != "" {
+					header.Set("Vary", value)
+				}
+
+				source := new(WebSource)
+				source.responseHeaders = &header
+				sources[strconv.Itoa(i)] = source
+			}
+
+			mergeVary(page, sources)
+
+			if got := page.Get("Vary"); got != test.expected {
+				t.Errorf("Vary %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
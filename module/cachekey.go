@@ -0,0 +1,219 @@
+package module
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Headers ignored in the Vary of a component, the http client negotiates
+// the encoding on its own.
+var ignoredVaryHeaders = []string{
+	"Accept-Encoding",
+}
+
+// CacheKey lists the parts of the page request a service response depends
+// on, so each combination is cached apart.
+type CacheKey struct {
+	// Request headers added to the key.
+	Headers []string `json:"headers,omitempty"`
+
+	// Cookies added to the key.
+	Cookies []string `json:"cookies,omitempty"`
+
+	// Query parameters of the page url added to the key.
+	Query []string `json:"query,omitempty"`
+}
+
+func (k *CacheKey) parts(request *http.Request) []string {
+	var result []string
+
+	for _, name := range k.Headers {
+		result = append(result, headerKeyPart(request.Header, name))
+	}
+
+	for _, name := range k.Cookies {
+		value := ""
+		cookie, err := request.Cookie(name)
+
+		if err == nil {
+			value = cookie.Value
+		}
+
+		result = append(result, "cookie:"+name+"="+value)
+	}
+
+	query := request.URL.Query()
+
+	for _, name := range k.Query {
+		result = append(result, "query:"+name+"="+strings.Join(query[name], ","))
+	}
+
+	return result
+}
+
+func headerKeyPart(header http.Header, name string) string {
+	return "header:" + http.CanonicalHeaderKey(name) + "=" + strings.Join(header.Values(name), ",")
+}
+
+// applyCacheKey calculates the id of the source from the parts of the page
+// request it depends on: the ones configured in its service and the Vary
+// headers learned from previous responses.
+func (ctx *ComposeContext) applyCacheKey(s *WebSource) {
+	s.keyParts = nil
+
+	if s.service != nil && s.service.CacheKey != nil {
+		s.keyParts = s.service.CacheKey.parts(ctx.httpRequest)
+	}
+
+	s.baseId = s.calculateId()
+	varies := ctx.webComposer.cache.varyHeaders(*s.baseId)
+
+	if len(varies) > 0 {
+		forwarded := ctx.forwardedHeader(s)
+
+		for _, name := range varies {
+			s.keyParts = append(s.keyParts, headerKeyPart(forwarded, name))
+		}
+	}
+
+	s.id = s.calculateId()
+}
+
+// forwardedHeader returns the headers the request of the source carries,
+// the ones of the page request left by the forwarding rules and renamed, as
+// the Vary of the response names them.
+func (ctx *ComposeContext) forwardedHeader(s *WebSource) http.Header {
+	request := &http.Request{URL: new(url.URL), Header: make(http.Header)}
+
+	if s.service != nil && len(s.service.upstreams) > 0 {
+		request.URL = s.service.upstreams[0].baseUrl
+	} else if parsed, err := url.Parse(*s.url); err == nil {
+		request.URL = parsed
+	}
+
+	ctx.handoverRequestHeader(request, s.service)
+	return request.Header
+}
+
+// varyCacheKeys adds to the Vary of the page the request headers and the
+// cookies its components are keyed by, so a shared cache keeps the page of
+// each user apart.
+func varyCacheKeys(page http.Header, sources map[string]*WebSource) {
+	var keyed []string
+
+	for _, source := range sources {
+		if source.service == nil || source.service.CacheKey == nil {
+			continue
+		}
+
+		keyed = append(keyed, source.service.CacheKey.Headers...)
+
+		if len(source.service.CacheKey.Cookies) > 0 {
+			keyed = append(keyed, "Cookie")
+		}
+	}
+
+	var names []string
+
+	for _, value := range page.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	if containsString(names, "*") {
+		return
+	}
+
+	added := false
+
+	for _, name := range keyed {
+		if !containsHeaderName(names, name) {
+			names = append(names, http.CanonicalHeaderKey(name))
+			added = true
+		}
+	}
+
+	if added {
+		page.Set("Vary", strings.Join(names, ", "))
+	}
+}
+
+// dependsOnRequest tells if the id of the source was calculated with parts
+// of a page request. The parts themselves are not kept on disk, as they
+// hold the cookies and headers of the users.
+func (s *WebSource) dependsOnRequest() bool {
+	return *s.id != *newSource(s.method, s.url, s.body).id
+}
+
+// varyNames returns the headers a response varies on, sorted so the same
+// Vary always builds the same key.
+func varyNames(header *http.Header) []string {
+	if header == nil {
+		return nil
+	}
+
+	var result []string
+
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+
+			if name != "" && !containsHeaderName(ignoredVaryHeaders, name) && !containsString(result, name) {
+				result = append(result, name)
+			}
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func varyAll(header *http.Header) bool {
+	return containsString(varyNames(header), "*")
+}
+
+// normalizeUrl sorts the query parameters, so the order they are written
+// in does not change the cache key.
+func normalizeUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+
+	if err != nil || parsed.RawQuery == "" {
+		return rawUrl
+	}
+
+	parsed.RawQuery = parsed.Query().Encode()
+	return parsed.String()
+}
+
+func (c *Cache) varyHeaders(baseId string) []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.varies[baseId]
+}
+
+// learnVary records the headers the responses of a source vary on,
+// reporting whether they changed.
+func (c *Cache) learnVary(baseId string, names []string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	current := c.varies[baseId]
+
+	if strings.Join(current, ",") == strings.Join(names, ",") {
+		return false
+	}
+
+	if len(names) == 0 {
+		delete(c.varies, baseId)
+	} else {
+		c.varies[baseId] = names
+	}
+
+	return true
+}
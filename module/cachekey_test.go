@@ -0,0 +1,125 @@
+package module
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The Vary of a component names the headers of the request sent to it, so
+// the key takes them after the forwarding rules.
+func TestApplyCacheKeyForwardedVary(t *testing.T) {
+	rule := &HeaderForwarding{
+		Hosts:  []string{"*.example.org"},
+		Allow:  []string{"Accept-Language"},
+		Rename: map[string]string{"Accept-Language": "X-Locale"},
+	}
+
+	if err := rule.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &WebComposer{HeaderForwarding: []*HeaderForwarding{rule}}
+	w.cache = w.createCache()
+
+	tests := []struct {
+		name      string
+		url       string
+		vary      string
+		header    string
+		different bool
+	}{
+		{"renamed header", "https://cdn.example.org/a", "X-Locale", "Accept-Language", true},
+		{"name of the page request", "https://cdn.example.org/b", "Accept-Language", "Accept-Language", false},
+		{"not forwarded", "https://example.net/a", "X-Request-Id", "X-Request-Id", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := func(value string) string {
+				page := httptest.NewRequest(GET, "https://www.example.com/page", nil)
+				page.Header.Set(test.header, value)
+
+				method, url := GET, test.url
+				source := newSource(&method, &url, nil)
+				ctx := &ComposeContext{webComposer: w, httpRequest: page}
+				ctx.applyCacheKey(source)
+				w.cache.learnVary(*source.baseId, []string{test.vary})
+				ctx.applyCacheKey(source)
+
+				return *source.id
+			}
+
+			if different := id("en") != id("de"); different != test.different {
+				t.Errorf("ids different %t, expected %t", different, test.different)
+			}
+		})
+	}
+}
+
+func TestVaryCacheKeys(t *testing.T) {
+	keyed := func(key *CacheKey) map[string]*WebSource {
+		method, url := GET, "svc://catalog/a"
+		source := newSource(&method, &url, nil)
+		source.service = &Service{CacheKey: key}
+		return map[string]*WebSource{*source.id: source}
+	}
+
+	tests := []struct {
+		name     string
+		vary     string
+		sources  map[string]*WebSource
+		expected string
+	}{
+		{"cookies", "", keyed(&CacheKey{Cookies: []string{"session"}}), "Cookie"},
+		{"headers added to the page ones", "Accept-Encoding", keyed(&CacheKey{Headers: []string{"x-tenant"}}), "Accept-Encoding, X-Tenant"},
+		{"already varied", "cookie", keyed(&CacheKey{Cookies: []string{"session"}}), "cookie"},
+		{"query only", "", keyed(&CacheKey{Query: []string{"page"}}), ""},
+		{"vary all", "*", keyed(&CacheKey{Cookies: []string{"session"}}), "*"},
+		{"no cache key", "", keyed(nil), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := make(http.Header)
+
+			if test.vary != "" {
+				page.Set("Vary", test.vary)
+			}
+
+			varyCacheKeys(page, test.sources)
+
+			if got := page.Get("Vary"); got != test.expected {
+				t.Errorf("Vary %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+// The Vary learned for a source is dropped with its last entry in memory.
+func TestSweepVaries(t *testing.T) {
+	cache := new(WebComposer).createCache()
+	cache.limits = &MemoryCache{}
+	cache.limits.provision()
+
+	method, kept, dropped := GET, "https://example.org/kept", "https://example.org/dropped"
+	validUntil := time.Now().Add(time.Minute)
+
+	for _, url := range []string{kept, dropped} {
+		url := url
+		source := newSource(&method, &url, nil)
+		source.baseId = source.id
+		cache.learnVary(*source.baseId, []string{"Accept-Language"})
+
+		if url == kept {
+			cache.set(source, &validUntil)
+		}
+	}
+
+	cache.sweep(time.Now())
+
+	if len(cache.varies) != 1 || cache.varyHeaders(*newSource(&method, &kept, nil).id) == nil {
+		t.Errorf("varies %v, expected the one of %s", cache.varies, kept)
+	}
+}
@@ -0,0 +1,310 @@
+package module
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var errCircuitOpen = errors.New("Circuit breaker open")
+
+// Host breakers unused for this time are dropped, so the components of
+// many hosts do not keep a breaker each.
+const hostBreakerIdle = 10 * time.Minute
+
+type CircuitBreaker struct {
+	// Ratio of failed requests (0-1) in the window that opens the circuit.
+	ErrorRate float64 `json:"error_rate,omitempty"`
+
+	// Responses slower than this are counted as failures, disabled when zero.
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// Requests needed in the window before the error rate is evaluated.
+	MinRequests int `json:"min_requests,omitempty"`
+
+	// Length of the window the error rate is calculated over.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// Time the circuit stays open before letting probe requests through.
+	OpenDuration caddy.Duration `json:"open_duration,omitempty"`
+
+	// Probe requests allowed while half-open. The circuit closes when all
+	// of them succeed and opens again on the first failure.
+	HalfOpenRequests int `json:"half_open_requests,omitempty"`
+}
+
+type circuitBreaker struct {
+	name        string
+	config      *CircuitBreaker
+	mutex       sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	halfOpenAt  time.Time
+	probes      int
+	successes   int
+	group       *circuitBreakers
+	lastUsed    time.Time
+	dropped     bool
+}
+
+// circuitBreakers keeps the breakers of the hosts. They are reported
+// together, under the no service label, with the worst of their states.
+type circuitBreakers struct {
+	config    *CircuitBreaker
+	mutex     sync.Mutex
+	breakers  map[string]*circuitBreaker
+	states    [3]int64
+	lastSweep time.Time
+}
+
+func (c *CircuitBreaker) provision() error {
+	if c.ErrorRate == 0 {
+		c.ErrorRate = 0.5
+	}
+
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return errors.Errorf("Circuit breaker error rate %f must be between 0 and 1", c.ErrorRate)
+	}
+
+	if c.MinRequests <= 0 {
+		c.MinRequests = 10
+	}
+
+	if c.Window <= 0 {
+		c.Window = caddy.Duration(10 * time.Second)
+	}
+
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = caddy.Duration(30 * time.Second)
+	}
+
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+
+	return nil
+}
+
+func newCircuitBreaker(config *CircuitBreaker, name string) *circuitBreaker {
+	result := new(circuitBreaker)
+	result.name = name
+	result.config = config
+	result.windowStart = time.Now()
+	result.setState(circuitClosed)
+	return result
+}
+
+func newHostBreaker(group *circuitBreakers) *circuitBreaker {
+	result := new(circuitBreaker)
+	result.name = noServiceLabel
+	result.config = group.config
+	result.windowStart = time.Now()
+	result.group = group
+	result.state = circuitClosed
+	group.changeState(-1, circuitClosed)
+	return result
+}
+
+// allow reports whether a request can be sent, moving an open circuit
+// to half-open once the open duration is over.
+func (b *circuitBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < time.Duration(b.config.OpenDuration) {
+			return errCircuitOpen
+		}
+		b.setState(circuitHalfOpen)
+		b.halfOpenAt = time.Now()
+		b.probes = 1
+		b.successes = 0
+		return nil
+	case circuitHalfOpen:
+		if b.probes >= b.config.HalfOpenRequests {
+			// probes never recorded would keep the circuit half-open
+			// forever, they are considered lost after the open duration
+			if time.Since(b.halfOpenAt) < time.Duration(b.config.OpenDuration) {
+				return errCircuitOpen
+			}
+			b.halfOpenAt = time.Now()
+			b.probes = b.successes
+		}
+		b.probes++
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (b *circuitBreaker) record(duration time.Duration, statusCode int, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	failed := err != nil || statusCode >= 500 ||
+		(b.config.Latency > 0 && duration > time.Duration(b.config.Latency))
+
+	switch b.state {
+	case circuitHalfOpen:
+		if failed {
+			b.open()
+		} else {
+			b.successes++
+			if b.successes >= b.config.HalfOpenRequests {
+				b.close()
+			}
+		}
+	case circuitClosed:
+		if time.Since(b.windowStart) > time.Duration(b.config.Window) {
+			b.resetWindow()
+		}
+
+		b.requests++
+		if failed {
+			b.failures++
+		}
+
+		if b.requests >= b.config.MinRequests && float64(b.failures)/float64(b.requests) >= b.config.ErrorRate {
+			b.open()
+		}
+	}
+}
+
+// release gives back the probe of a request that was allowed but not
+// completed.
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == circuitHalfOpen && b.probes > b.successes {
+		b.probes--
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.setState(circuitOpen)
+	b.openedAt = time.Now()
+}
+
+func (b *circuitBreaker) close() {
+	b.setState(circuitClosed)
+	b.resetWindow()
+}
+
+func (b *circuitBreaker) setState(state int) {
+	if b.group != nil {
+		// a dropped breaker may still be used by a request in flight
+		if !b.dropped {
+			b.group.changeState(b.state, state)
+		}
+		b.state = state
+		return
+	}
+
+	b.state = state
+	composerMetrics.circuitState.WithLabelValues(b.name).Set(float64(state))
+}
+
+func (b *circuitBreaker) resetWindow() {
+	b.windowStart = time.Now()
+	b.requests = 0
+	b.failures = 0
+}
+
+func newCircuitBreakers(config *CircuitBreaker) *circuitBreakers {
+	result := new(circuitBreakers)
+	result.config = config
+	result.breakers = make(map[string]*circuitBreaker)
+	return result
+}
+
+func (c *circuitBreakers) get(host string) *circuitBreaker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(c.lastSweep) > hostBreakerIdle {
+		c.sweep(now)
+	}
+
+	breaker := c.breakers[host]
+
+	if breaker == nil {
+		breaker = newHostBreaker(c)
+		c.breakers[host] = breaker
+	}
+
+	breaker.lastUsed = now
+	return breaker
+}
+
+// sweep drops the closed breakers idle for longer than hostBreakerIdle, the
+// open ones are kept to keep failing fast. The mutex must be held.
+func (c *circuitBreakers) sweep(now time.Time) {
+	c.lastSweep = now
+
+	for host, breaker := range c.breakers {
+		if now.Sub(breaker.lastUsed) <= hostBreakerIdle {
+			continue
+		}
+
+		breaker.mutex.Lock()
+
+		if breaker.state == circuitClosed {
+			breaker.dropped = true
+			delete(c.breakers, host)
+			c.changeState(circuitClosed, -1)
+		}
+
+		breaker.mutex.Unlock()
+	}
+}
+
+// changeState counts a host breaker moving from a state to another, -1
+// when it is created or dropped, and reports the worst state.
+func (c *circuitBreakers) changeState(from int, to int) {
+	if from >= 0 {
+		atomic.AddInt64(&c.states[from], -1)
+	}
+
+	if to >= 0 {
+		atomic.AddInt64(&c.states[to], 1)
+	}
+
+	state := circuitClosed
+
+	if atomic.LoadInt64(&c.states[circuitOpen]) > 0 {
+		state = circuitOpen
+	} else if atomic.LoadInt64(&c.states[circuitHalfOpen]) > 0 {
+		state = circuitHalfOpen
+	}
+
+	composerMetrics.circuitState.WithLabelValues(noServiceLabel).Set(float64(state))
+}
+
+// circuitBreaker returns the breaker guarding the source, the one of its
+// service or the one of its host, nil when none is configured.
+func (w *WebComposer) circuitBreaker(s *WebSource, host string) *circuitBreaker {
+	if s.service != nil {
+		return s.service.breaker
+	}
+
+	if w.hostBreakers != nil {
+		return w.hostBreakers.get(host)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package module
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func testBreakerConfig() *CircuitBreaker {
+	return &CircuitBreaker{
+		ErrorRate:        0.5,
+		Latency:          caddy.Duration(100 * time.Millisecond),
+		MinRequests:      4,
+		Window:           caddy.Duration(10 * time.Second),
+		OpenDuration:     caddy.Duration(30 * time.Second),
+		HalfOpenRequests: 2,
+	}
+}
+
+// runBreakerSteps applies the steps to the breaker, checking its state after
+// each one. allow and deny expect the request to be let through or not.
+func runBreakerSteps(t *testing.T, breaker *circuitBreaker, steps string) {
+	t.Helper()
+
+	for i, step := range strings.Fields(steps) {
+		action, state, _ := strings.Cut(step, ":")
+
+		switch action {
+		case "allow", "deny":
+			err := breaker.allow()
+
+			if (err == nil) != (action == "allow") {
+				t.Fatalf("step %d %s: allow returned %v", i, step, err)
+			}
+		case "success":
+			breaker.record(time.Millisecond, 200, nil)
+		case "failure":
+			breaker.record(time.Millisecond, 500, nil)
+		case "error":
+			breaker.record(time.Millisecond, 0, errors.New("connection refused"))
+		case "slow":
+			breaker.record(time.Second, 200, nil)
+		case "release":
+			breaker.release()
+		case "wait-window":
+			breaker.windowStart = breaker.windowStart.Add(-time.Duration(breaker.config.Window) - time.Millisecond)
+		case "wait-open":
+			breaker.openedAt = breaker.openedAt.Add(-time.Duration(breaker.config.OpenDuration) - time.Millisecond)
+			breaker.halfOpenAt = breaker.halfOpenAt.Add(-time.Duration(breaker.config.OpenDuration) - time.Millisecond)
+		default:
+			t.Fatalf("unknown step %s", step)
+		}
+
+		expected := map[string]int{"closed": circuitClosed, "open": circuitOpen, "half": circuitHalfOpen}[state]
+
+		if state != "" && breaker.state != expected {
+			t.Fatalf("step %d %s: state %d, expected %d", i, step, breaker.state, expected)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	initComposerMetrics()
+
+	tests := []struct {
+		name  string
+		steps string
+	}{
+		{"closed below min requests", "failure failure failure:closed allow"},
+		{"opens at the error rate", "success success failure failure:open deny"},
+		{"closed below the error rate", "success success success failure:closed allow"},
+		{"slow responses fail", "slow slow slow slow:open deny"},
+		{"errors fail", "error error error error:open deny"},
+		{"window reset", "failure failure failure wait-window success failure:closed failure failure:open"},
+		{"open until the open duration", "failure failure failure failure:open deny wait-open allow:half"},
+		{"probes limited while half-open", "failure failure failure failure wait-open allow:half allow:half deny:half"},
+		{"closes when the probes succeed", "failure failure failure failure wait-open allow allow success:half success:closed allow"},
+		{"opens again on a probe failure", "failure failure failure failure wait-open allow allow success:half failure:open deny"},
+		{"released probes given back", "failure failure failure failure wait-open allow allow deny release:half allow:half deny"},
+		{"release only while half-open", "release:closed failure failure failure failure release:open deny"},
+		{"lost probes expire", "failure failure failure failure wait-open allow allow deny wait-open allow:half allow deny"},
+		{"recorded probes kept on expiry", "failure failure failure failure wait-open allow allow success wait-open allow success:closed"},
+		{"closed window reset", "failure failure failure failure wait-open allow allow success success:closed failure failure failure:closed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runBreakerSteps(t, newCircuitBreaker(testBreakerConfig(), "test"), test.steps)
+		})
+	}
+}
+
+func TestCircuitBreakerProvision(t *testing.T) {
+	config := new(CircuitBreaker)
+
+	if err := config.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ErrorRate != 0.5 || config.MinRequests != 10 || config.HalfOpenRequests != 1 ||
+		config.Window != caddy.Duration(10*time.Second) || config.OpenDuration != caddy.Duration(30*time.Second) {
+		t.Errorf("unexpected defaults %+v", config)
+	}
+
+	if err := (&CircuitBreaker{ErrorRate: 1.5}).provision(); err == nil {
+		t.Error("error rate over 1 accepted")
+	}
+}
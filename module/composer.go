@@ -1,12 +1,14 @@
 package module
 
 import (
-	"github.com/andybalholm/cascadia"
+	"bytes"
+	"context"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/pkg/errors"
 	"golang.org/x/net/html"
 	"net/http"
-	"strings"
+	"sync"
+	"time"
 )
 
 const GET = "get"
@@ -14,6 +16,7 @@ const AttributeUrlKey = "data-webc-url"
 const AttributeMethodKey = "data-webc-method"
 const AttributeNameKey = "data-webc-name"
 const AttributeBodyKey = "data-webc-body"
+const AttributePrefix = "data-webc-"
 
 type ComposeContext struct {
 	webComposer  *WebComposer
@@ -21,6 +24,13 @@ type ComposeContext struct {
 	httpRequest  *http.Request
 	httpResponse *caddyhttp.ResponseRecorder
 	cache        *Cache
+	context      context.Context
+	cancel       context.CancelFunc
+	sources      map[string]*WebSource
+	sourcesLock  *sync.Mutex
+	streaming    bool
+	composed     bool
+	timings      *serverTimings
 }
 
 func (ctx *ComposeContext) compose(payload string) (*string, error) {
@@ -31,13 +41,13 @@ func (ctx *ComposeContext) compose(payload string) (*string, error) {
 	}
 
 	if ctx.isDebugEnabled() {
-		head := cascadia.MustCompile("head").MatchFirst(doc)
+		head := headSelector.MatchFirst(doc)
 
 		if head != nil{
 			appendContent(head, debugStyleNode())
 		}
 
-		body := cascadia.MustCompile("body").MatchFirst(doc)
+		body := bodySelector.MatchFirst(doc)
 
 		if body != nil{
 			appendContent(body, debugModalNode())
@@ -54,10 +64,39 @@ func (ctx *ComposeContext) compose(payload string) (*string, error) {
 	return renderToString(doc)
 }
 
+// containsMarker reports whether the payload may have a placeholder, so the
+// pages without any are sent untouched instead of being parsed and rendered.
+func containsMarker(payload []byte) bool {
+	marker := []byte(AttributePrefix)
+
+	for i := 0; i+len(marker) <= len(payload); i++ {
+		if (payload[i] == 'd' || payload[i] == 'D') && bytes.EqualFold(payload[i:i+len(marker)], marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addSource records a source used by the page, the components of a
+// streamed page are loaded concurrently.
+func (ctx *ComposeContext) addSource(source *WebSource) {
+	ctx.sourcesLock.Lock()
+	defer ctx.sourcesLock.Unlock()
+
+	ctx.sources[*source.id] = source
+}
+
+func (ctx *ComposeContext) close() {
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+}
+
 func (ctx *ComposeContext) composeNode(doc *html.Node, node *html.Node) error {
 	defaultMethod := GET
 
-	divs := cascadia.MustCompile("div").MatchAll(node)
+	divs := divSelector.MatchAll(node)
 	for _, div := range divs {
 		url := attr(div, AttributeUrlKey, nil)
 		method := attr(div, AttributeMethodKey, &defaultMethod)
@@ -71,6 +110,7 @@ func (ctx *ComposeContext) composeNode(doc *html.Node, node *html.Node) error {
 
 			if err != nil {
 				ctx.logCompositionError("composition error", url, method, name, err)
+				ctx.webComposer.countFallback("placeholder")
 			} else {
 				_ = ctx.replaceComponent(doc, webComponent, div)
 			}
@@ -96,68 +136,125 @@ func (ctx *ComposeContext) replaceComponent(doc *html.Node, component *WebCompon
 	ctx.handoverResponseHeader(component.headers)
 	replaceContent(dst, content)
 
-	head := cascadia.MustCompile("head").MatchFirst(doc)
-	attachIfRequired(head, "link", "href", component.stylesheets)
+	head := headSelector.MatchFirst(doc)
+	attachIfRequired(head, linkSelector, "href", component.stylesheets)
 
-	body := cascadia.MustCompile("body").MatchFirst(doc)
-	attachIfRequired(body, "script", "src", component.scripts)
+	body := bodySelector.MatchFirst(doc)
+	attachIfRequired(body, scriptSelector, "src", component.scripts)
 
 	return nil
 }
 
 func (ctx *ComposeContext) handoverResponseHeader(header *http.Header) {
-	for key, values := range *header {
-		if ctx.mustHandoverHeader(key) {
-			response := *ctx.httpResponse
-
-			for _, value := range values {
-				if !containsHeaderValue(response.Header(), key, value) {
-					response.Header().Add(key, value)
-				}
-			}
-		}
+	// the headers of a streamed page are already sent
+	if ctx.streaming {
+		return
 	}
+
+	response := *ctx.httpResponse
+	ctx.webComposer.ResponseHeaders.merge(response.Header(), *header)
 }
 
 func (ctx ComposeContext) getWebComponent(method *string, url *string, body *string, name *string) (*WebComponent, error) {
+	service, err := ctx.webComposer.findService(url)
+
+	if err != nil {
+		return nil, err
+	}
+
 	source := newSource(method, url, body)
+	source.service = service
+
+	err = ctx.webComposer.UpstreamPolicy.checkSource(source)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Component rejected")
+	}
+
+	ctx.applyCacheKey(source)
+
+	if ctx.webComposer.cache.isMissing(*source.id, *name) {
+		return nil, errComponentNotFound{name: *name}
+	}
 
+	started := time.Now()
+	lookup := "miss"
+	defer func() {
+		ctx.timings.add(*name, lookup, source.elapsed(lookup, started))
+	}()
+
+	lookupSpan := ctx.startCacheLookup(source)
 	loadedSource, _ := ctx.webComposer.cache.get(source.id)
 
-	if loadedSource == nil {
+	if loadedSource != nil {
+		lookup = "hit"
+		ctx.webComposer.cache.countLookup(lookup)
+	} else {
 		loadedSource, _ = ctx.cache.get(source.id)
+
+		if loadedSource != nil {
+			lookup = "request"
+		}
 	}
 
+	endCacheLookup(lookupSpan, lookup)
+
 	if loadedSource == nil {
+		ctx.webComposer.cache.countLookup("miss")
 		err := source.load(ctx)
 
+		if err == nil && *source.responseStatusCode >= http.StatusInternalServerError {
+			err = sourceStatusError(source)
+		}
+
 		if err != nil {
-			return nil, err
+			staleSource, _ := ctx.webComposer.cache.getStale(source.id)
+
+			if staleSource == nil || sourceStatusError(staleSource) != nil {
+				if source.responseStatusCode != nil {
+					ctx.storeSource(source)
+				}
+
+				return nil, err
+			}
+
+			ctx.logCompositionError("composition serving stale copy", method, url, name, err)
+			lookup = "stale"
+			ctx.webComposer.countFallback(lookup)
+			ctx.webComposer.cache.countLookup(lookup)
+			ctx.holdStale(staleSource, source)
+			ctx.addSource(staleSource)
+			return ctx.getCachedComponent(staleSource, name)
 		}
 
 		loadedSource = source
-		ctx.cache.set(loadedSource, nil)
 
-		if loadedSource.cachedUntil != nil {
-			ctx.webComposer.cache.set(loadedSource, loadedSource.cachedUntil)
+		if ctx.webComposer.cache.learnVary(*source.baseId, varyNames(source.responseHeaders)) {
+			ctx.applyCacheKey(source)
 		}
 
-		if *loadedSource.responseStatusCode != 200 {
-			err := errors.Errorf("The remote response was %d", *loadedSource.responseStatusCode)
-			return nil, err
-		}
+		ctx.storeSource(loadedSource)
 	}
 
 	if loadedSource == nil {
 		return nil, errors.Errorf("Component source invalid")
 	}
 
-	return loadedSource.getWebComponent(name)
+	err = sourceStatusError(loadedSource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.addSource(loadedSource)
+
+	return ctx.getCachedComponent(loadedSource, name)
 }
 
-func (ctx *ComposeContext) mustHandoverHeader(key string) bool {
-	return strings.HasPrefix(key, "X-") ||
-		strings.EqualFold(key, "Set-Cookie") ||
-		strings.EqualFold(key, "Cookie") ||
-		strings.EqualFold(key, "Authorization")
+func (ctx *ComposeContext) storeSource(source *WebSource) {
+	ctx.cache.set(source, nil)
+
+	if source.cachedUntil != nil {
+		ctx.webComposer.cache.set(source, source.cachedUntil)
+	}
 }
@@ -0,0 +1,96 @@
+package module
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Directives applied to the inline script elements, in order of precedence.
+var inlineScriptDirectives = []string{"script-src-elem", "script-src", "default-src"}
+
+// inlineScriptNonce reports whether the Content-Security-Policy of the page
+// lets inline scripts run, and the nonce they must carry for it, empty when
+// none is needed. Report only policies do not block, so they are ignored.
+func inlineScriptNonce(header http.Header) (string, bool) {
+	nonce := ""
+
+	for _, value := range header.Values("Content-Security-Policy") {
+		for _, policy := range strings.Split(value, ",") {
+			sources, found := inlineScriptSources(policy)
+
+			if !found {
+				continue
+			}
+
+			policyNonce, allowed := sourcesNonce(sources)
+
+			if !allowed {
+				return "", false
+			}
+
+			if policyNonce == "" {
+				continue
+			}
+
+			// every policy must allow the script, it can carry one nonce
+			if nonce != "" && nonce != policyNonce {
+				return "", false
+			}
+
+			nonce = policyNonce
+		}
+	}
+
+	return nonce, true
+}
+
+// inlineScriptSources returns the sources of the directive of the policy
+// applied to the inline scripts.
+func inlineScriptSources(policy string) ([]string, bool) {
+	directives := make(map[string][]string)
+
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(fields[0])
+
+		// the first occurrence of a directive wins
+		if _, found := directives[name]; !found {
+			directives[name] = fields[1:]
+		}
+	}
+
+	for _, name := range inlineScriptDirectives {
+		if sources, found := directives[name]; found {
+			return sources, true
+		}
+	}
+
+	return nil, false
+}
+
+// sourcesNonce reports whether the sources allow an inline script, and the
+// nonce it needs. unsafe-inline is ignored when a nonce or hash is listed.
+func sourcesNonce(sources []string) (string, bool) {
+	unsafeInline := false
+	hashes := false
+
+	for _, source := range sources {
+		lower := strings.ToLower(source)
+
+		switch {
+		case strings.HasPrefix(lower, "'nonce-") && strings.HasSuffix(lower, "'"):
+			return source[len("'nonce-") : len(source)-1], true
+		case lower == "'unsafe-inline'":
+			unsafeInline = true
+		case strings.HasPrefix(lower, "'sha256-"), strings.HasPrefix(lower, "'sha384-"), strings.HasPrefix(lower, "'sha512-"):
+			hashes = true
+		}
+	}
+
+	return "", unsafeInline && !hashes
+}
@@ -0,0 +1,45 @@
+package module
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestInlineScriptNonce(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []string
+		nonce    string
+		allowed  bool
+	}{
+		{"no policy", nil, "", true},
+		{"no script directive", []string{"img-src 'self'"}, "", true},
+		{"self only", []string{"default-src 'self'"}, "", false},
+		{"unsafe inline", []string{"script-src 'self' 'unsafe-inline'"}, "", true},
+		{"nonce", []string{"script-src 'nonce-abc' 'strict-dynamic'"}, "abc", true},
+		{"nonce ignores unsafe inline", []string{"script-src 'unsafe-inline' 'nonce-abc'"}, "abc", true},
+		{"hash ignores unsafe inline", []string{"script-src 'unsafe-inline' 'sha256-xyz'"}, "", false},
+		{"script-src over default-src", []string{"default-src 'self'; script-src 'unsafe-inline'"}, "", true},
+		{"script-src-elem over script-src", []string{"script-src 'unsafe-inline'; script-src-elem 'self'"}, "", false},
+		{"first directive wins", []string{"script-src 'self'; script-src 'unsafe-inline'"}, "", false},
+		{"every policy applies", []string{"script-src 'unsafe-inline'", "default-src 'self'"}, "", false},
+		{"policies in one header", []string{"script-src 'unsafe-inline', script-src 'nonce-abc'"}, "abc", true},
+		{"different nonces", []string{"script-src 'nonce-abc'", "script-src 'nonce-def'"}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+
+			for _, policy := range test.policies {
+				header.Add("Content-Security-Policy", policy)
+			}
+
+			nonce, allowed := inlineScriptNonce(header)
+
+			if nonce != test.nonce || allowed != test.allowed {
+				t.Errorf("got (%q, %v), expected (%q, %v)", nonce, allowed, test.nonce, test.allowed)
+			}
+		})
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"github.com/andybalholm/cascadia"
 	"golang.org/x/net/html"
 	"math/rand"
+	"net/http"
 	"time"
 )
 
 func (ctx *ComposeContext) isDebugEnabled() bool {
-	for key, values := range ctx.httpRequest.URL.Query() {
+	return isDebugRequest(ctx.httpRequest)
+}
+
+func isDebugRequest(r *http.Request) bool {
+	for key, values := range r.URL.Query() {
 		if key == "debug" {
 			for _, value := range values {
 				if value == "true" {
@@ -0,0 +1,445 @@
+package module
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var diskBucket = []byte("sources")
+
+// Writes waiting for the disk worker, the ones over it are dropped as the
+// memory tier keeps the sources anyway.
+const diskQueueSize = 1024
+
+// diskStores keeps the databases open across config reloads, bbolt locks
+// the file so the new handler could not open it while the old one lives.
+var diskStores = caddy.NewUsagePool()
+
+// DiskCache stores the cached components on disk, so they survive
+// restarts and deploys.
+type DiskCache struct {
+	// File of the database, relative to the Caddy data directory.
+	// web-composer/cache.db when empty.
+	Path string `json:"path,omitempty"`
+
+	// Time an expired entry is kept to be served as stale copy, 24h when
+	// zero.
+	MaxStale caddy.Duration `json:"max_stale,omitempty"`
+
+	// Time between two removals of the entries expired for longer than
+	// max stale, 1h when zero.
+	PruneInterval caddy.Duration `json:"prune_interval,omitempty"`
+}
+
+// diskStore writes in background, so the requests storing a source do not
+// wait for the disk.
+type diskStore struct {
+	db     *bbolt.DB
+	logger *zap.Logger
+	writes chan diskWrite
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// diskWrite stores a source, or deletes the id when stored is nil, sending
+// whether it was found to deleted.
+type diskWrite struct {
+	id      string
+	stored  *storedSource
+	deleted chan bool
+}
+
+type storedSource struct {
+	Id          *string     `json:"id,omitempty"`
+	BaseId      *string     `json:"base_id,omitempty"`
+	Method      *string     `json:"method,omitempty"`
+	Url         *string     `json:"url,omitempty"`
+	Body        *string     `json:"body,omitempty"`
+	StatusCode  int         `json:"status_code"`
+	Headers     http.Header `json:"headers,omitempty"`
+	Content     string      `json:"content"`
+	CachedUntil *time.Time  `json:"cached_until,omitempty"`
+}
+
+func (d *DiskCache) provision() {
+	if d.Path == "" {
+		d.Path = filepath.Join("web-composer", "cache.db")
+	}
+
+	if !filepath.IsAbs(d.Path) {
+		d.Path = filepath.Join(caddy.AppDataDir(), d.Path)
+	}
+
+	if d.MaxStale <= 0 {
+		d.MaxStale = caddy.Duration(24 * time.Hour)
+	}
+
+	if d.PruneInterval <= 0 {
+		d.PruneInterval = caddy.Duration(time.Hour)
+	}
+}
+
+// openDiskStore returns the store of the path, opening the database only
+// if no other handler has it open.
+func openDiskStore(config *DiskCache, logger *zap.Logger) (*diskStore, error) {
+	value, _, err := diskStores.LoadOrNew(config.Path, func() (caddy.Destructor, error) {
+		err := os.MkdirAll(filepath.Dir(config.Path), 0700)
+
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := bbolt.Open(config.Path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+
+		if err != nil {
+			return nil, err
+		}
+
+		store := &diskStore{db: db, logger: logger}
+		err = store.removeExpired(time.Duration(config.MaxStale))
+
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+
+		store.writes = make(chan diskWrite, diskQueueSize)
+		store.stop = make(chan struct{})
+		store.done = make(chan struct{})
+		go store.run(time.Duration(config.MaxStale), time.Duration(config.PruneInterval))
+
+		return store, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return value.(*diskStore), nil
+}
+
+func sameDiskCache(a *DiskCache, b *DiskCache) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Path == b.Path && a.MaxStale == b.MaxStale && a.PruneInterval == b.PruneInterval
+}
+
+func diskCachePath(config *DiskCache) string {
+	if config == nil {
+		return ""
+	}
+	return config.Path
+}
+
+func closeDiskStore(config *DiskCache) error {
+	_, err := diskStores.Delete(config.Path)
+	return err
+}
+
+// Destruct implements caddy.Destructor.
+func (d *diskStore) Destruct() error {
+	close(d.stop)
+	<-d.done
+	return d.db.Close()
+}
+
+// run applies the queued writes and removes the expired entries until the
+// store is destructed, applying the writes still queued then.
+func (d *diskStore) run(maxStale time.Duration, pruneInterval time.Duration) {
+	defer close(d.done)
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case write := <-d.writes:
+			d.apply(d.queued(write))
+		case <-ticker.C:
+			err := d.removeExpired(maxStale)
+
+			if err != nil {
+				d.logger.Error("disk cache prune error", zap.Error(err))
+			}
+		case <-d.stop:
+			for {
+				select {
+				case write := <-d.writes:
+					d.apply(d.queued(write))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// queued returns the write with the ones queued after it, so they are
+// applied in one transaction.
+func (d *diskStore) queued(first diskWrite) []diskWrite {
+	result := []diskWrite{first}
+
+	for len(result) < diskQueueSize {
+		select {
+		case write := <-d.writes:
+			result = append(result, write)
+		default:
+			return result
+		}
+	}
+
+	return result
+}
+
+func (d *diskStore) apply(writes []diskWrite) {
+	found := make([]bool, len(writes))
+
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(diskBucket)
+
+		if err != nil {
+			return err
+		}
+
+		for i, write := range writes {
+			if write.stored == nil {
+				found[i] = bucket.Get([]byte(write.id)) != nil
+				err = bucket.Delete([]byte(write.id))
+			} else {
+				var data []byte
+				data, err = json.Marshal(write.stored)
+
+				if err == nil {
+					err = bucket.Put([]byte(write.id), data)
+				}
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		d.logger.Error("disk cache write error", zap.Int("writes", len(writes)), zap.Error(err))
+	}
+
+	for i, write := range writes {
+		if write.deleted != nil {
+			write.deleted <- err == nil && found[i]
+		}
+	}
+}
+
+func (d *diskStore) get(id string) (*WebSource, *time.Time) {
+	var stored *storedSource
+
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(diskBucket)
+
+		if bucket == nil {
+			return nil
+		}
+
+		data := bucket.Get([]byte(id))
+
+		if data == nil {
+			return nil
+		}
+
+		stored = new(storedSource)
+		return json.Unmarshal(data, stored)
+	})
+
+	if err != nil {
+		d.logger.Error("disk cache read error", zap.String("source.id", id), zap.Error(err))
+		return nil, nil
+	}
+
+	if stored == nil {
+		return nil, nil
+	}
+
+	return stored.source(), stored.CachedUntil
+}
+
+// put queues the source to be written, dropping it when the queue is full.
+func (d *diskStore) put(source *WebSource, validUntil *time.Time) {
+	select {
+	case d.writes <- diskWrite{id: *source.id, stored: newStoredSource(source, validUntil)}:
+	default:
+		d.logger.Warn("disk cache queue full, write dropped", zap.String("source.id", *source.id))
+	}
+}
+
+// delete queues the deletion after the pending writes and waits for it, so
+// a source written before is not stored again.
+func (d *diskStore) delete(id string) bool {
+	deleted := make(chan bool, 1)
+
+	select {
+	case d.writes <- diskWrite{id: id, deleted: deleted}:
+	case <-d.done:
+		return false
+	}
+
+	select {
+	case found := <-deleted:
+		return found
+	case <-d.done:
+		// the worker answers before it is done, if it applied the delete
+		select {
+		case found := <-deleted:
+			return found
+		default:
+			return false
+		}
+	}
+}
+
+func (d *diskStore) ids() []string {
+	var result []string
+
+	_ = d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(diskBucket)
+
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key []byte, _ []byte) error {
+			result = append(result, string(key))
+			return nil
+		})
+	})
+
+	return result
+}
+
+func (d *diskStore) idsWithTag(tag string) []string {
+	return d.idsWhere(func(stored *storedSource) bool {
+		return containsString(parseTags(stored.Headers), tag)
+	})
+}
+
+func (d *diskStore) idsWithUrlPrefix(prefix string) []string {
+	return d.idsWhere(func(stored *storedSource) bool {
+		return strings.HasPrefix(stringOrEmpty(stored.Url), prefix)
+	})
+}
+
+func (d *diskStore) idsWhere(matches func(stored *storedSource) bool) []string {
+	var result []string
+
+	_ = d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(diskBucket)
+
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key []byte, data []byte) error {
+			stored := new(storedSource)
+
+			if json.Unmarshal(data, stored) == nil && matches(stored) {
+				result = append(result, string(key))
+			}
+			return nil
+		})
+	})
+
+	return result
+}
+
+// removeExpired deletes the entries expired for longer than maxStale.
+func (d *diskStore) removeExpired(maxStale time.Duration) error {
+	limit := time.Now().Add(-maxStale)
+
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(diskBucket)
+
+		if bucket == nil {
+			return nil
+		}
+
+		var expired [][]byte
+
+		err := bucket.ForEach(func(key []byte, data []byte) error {
+			stored := new(storedSource)
+
+			if json.Unmarshal(data, stored) != nil || stored.CachedUntil == nil || stored.CachedUntil.Before(limit) {
+				expired = append(expired, append([]byte{}, key...))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			err = bucket.Delete(key)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func newStoredSource(source *WebSource, validUntil *time.Time) *storedSource {
+	result := new(storedSource)
+	result.Id = source.id
+	result.BaseId = source.baseId
+	result.Method = source.method
+	result.Url = source.url
+	result.Body = source.body
+	result.CachedUntil = validUntil
+
+	if source.responseStatusCode != nil {
+		result.StatusCode = *source.responseStatusCode
+	}
+
+	if source.responseHeaders != nil {
+		result.Headers = *source.responseHeaders
+	}
+
+	if source.responseContent != nil {
+		result.Content = *source.responseContent
+	}
+
+	return result
+}
+
+func (s *storedSource) source() *WebSource {
+	result := newSource(s.Method, s.Url, s.Body)
+	result.baseId = s.BaseId
+
+	if s.Id != nil {
+		result.id = s.Id
+	}
+	result.responseStatusCode = &s.StatusCode
+	headers := s.Headers
+
+	if headers == nil {
+		headers = make(http.Header)
+	}
+
+	result.responseHeaders = &headers
+	result.responseContent = &s.Content
+	result.cachedUntil = s.CachedUntil
+
+	return result
+}
@@ -0,0 +1,142 @@
+package module
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The cookies and headers a source is keyed by stay out of the disk, only
+// the ids calculated from them are stored.
+func TestStoredSourceWithoutKeyParts(t *testing.T) {
+	method, url := GET, "https://example.org/a"
+	source := newSource(&method, &url, nil)
+	source.service = &Service{CacheKey: &CacheKey{Cookies: []string{"session"}}}
+
+	page := httptest.NewRequest(GET, "https://www.example.com/page", nil)
+	page.Header.Set("Cookie", "session=secret-token")
+
+	ctx := &ComposeContext{webComposer: &WebComposer{cache: new(WebComposer).createCache()}, httpRequest: page}
+	ctx.applyCacheKey(source)
+
+	status := 200
+	content := "<div></div>"
+	source.responseStatusCode = &status
+	source.responseContent = &content
+
+	validUntil := time.Now().Add(time.Minute)
+	data, err := json.Marshal(newStoredSource(source, &validUntil))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "secret-token") {
+		t.Errorf("cookie value stored: %s", data)
+	}
+
+	stored := new(storedSource)
+
+	if err := json.Unmarshal(data, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := stored.source()
+
+	if *restored.id != *source.id || *restored.baseId != *source.baseId {
+		t.Errorf("ids %s %s, expected %s %s", *restored.id, *restored.baseId, *source.id, *source.baseId)
+	}
+
+	if !restored.dependsOnRequest() {
+		t.Error("restored source does not depend on the request")
+	}
+
+	if newSource(&method, &url, nil).dependsOnRequest() {
+		t.Error("plain source depends on the request")
+	}
+}
+
+// The sources loaded from disk get the service of the current config.
+func TestDiskEntryService(t *testing.T) {
+	config := &DiskCache{Path: filepath.Join(t.TempDir(), "cache.db")}
+	config.provision()
+
+	store, err := openDiskStore(config, zap.NewNop())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = closeDiskStore(config) })
+
+	catalog := &Service{}
+	w := &WebComposer{Services: map[string]*Service{"catalog": catalog}, logger: zap.NewNop()}
+	validUntil := time.Now().Add(time.Minute)
+
+	method := GET
+	urls := []string{ServiceScheme + "://catalog/a", ServiceScheme + "://removed/a", "https://example.org/a"}
+	expected := []*Service{catalog, nil, nil}
+
+	for _, url := range urls {
+		url := url
+		source := newSource(&method, &url, nil)
+		store.apply([]diskWrite{{id: *source.id, stored: newStoredSource(source, &validUntil)}})
+	}
+
+	cache := w.createCache()
+	cache.store = store
+
+	for i, url := range urls {
+		entry := cache.entry(*newSource(&method, &url, nil).id)
+
+		if entry == nil {
+			t.Fatalf("%s not loaded", url)
+		}
+
+		if entry.source.service != expected[i] {
+			t.Errorf("%s service %v, expected %v", url, entry.source.service, expected[i])
+		}
+	}
+}
+
+// The purge by url prefix finds the sources only stored on disk.
+func TestPurgeUrlPrefixOnDisk(t *testing.T) {
+	config := &DiskCache{Path: filepath.Join(t.TempDir(), "cache.db")}
+	config.provision()
+
+	store, err := openDiskStore(config, zap.NewNop())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = closeDiskStore(config) })
+
+	cache := new(WebComposer).createCache()
+	cache.store = store
+	validUntil := time.Now().Add(time.Minute)
+
+	method := GET
+	memory, disk, other := "https://example.org/a/memory", "https://example.org/a/disk", "https://example.org/b"
+
+	for _, url := range []string{disk, other} {
+		url := url
+		source := newSource(&method, &url, nil)
+		store.apply([]diskWrite{{id: *source.id, stored: newStoredSource(source, &validUntil)}})
+	}
+
+	cache.set(newSource(&method, &memory, nil), &validUntil)
+
+	if purged := cache.purgeUrlPrefix("https://example.org/a/"); purged != 2 {
+		t.Errorf("purged %d, expected 2", purged)
+	}
+
+	if left := store.ids(); len(left) != 1 || left[0] != *newSource(&method, &other, nil).id {
+		t.Errorf("left on disk %v", left)
+	}
+}
@@ -0,0 +1,93 @@
+package module
+
+import (
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+var (
+	divSelector    = cascadia.MustCompile("div")
+	headSelector   = cascadia.MustCompile("head")
+	bodySelector   = cascadia.MustCompile("body")
+	linkSelector   = cascadia.MustCompile("link")
+	scriptSelector = cascadia.MustCompile("script")
+)
+
+// parsedSource is the DOM of a source response, parsed once and shared by
+// every page using the source. It is never modified, the nodes are cloned
+// before being composed.
+type parsedSource struct {
+	components  map[string]*html.Node
+	stylesheets []*html.Node
+	scripts     []*html.Node
+}
+
+// parse returns the DOM of the response, parsing it on the first call.
+func (s *WebSource) parse() (*parsedSource, error) {
+	s.parseOnce.Do(func() {
+		s.parsed, s.parseErr = parseSource(s.responseContent)
+	})
+
+	return s.parsed, s.parseErr
+}
+
+func parseSource(content *string) (*parsedSource, error) {
+	doc, err := parseString(content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(parsedSource)
+	result.components = make(map[string]*html.Node)
+
+	for _, div := range divSelector.MatchAll(doc) {
+		url := attr(div, AttributeUrlKey, nil)
+		name := attr(div, AttributeNameKey, nil)
+
+		if url == nil && name != nil {
+			result.components[*name] = div
+		}
+	}
+
+	head := headSelector.MatchFirst(doc)
+
+	if head != nil {
+		result.stylesheets = linkSelector.MatchAll(head)
+	}
+
+	body := bodySelector.MatchFirst(doc)
+
+	if body != nil {
+		result.scripts = scriptSelector.MatchAll(body)
+	}
+
+	return result, nil
+}
+
+// cloneNode returns a deep copy of the node, detached from its document.
+func cloneNode(node *html.Node) *html.Node {
+	result := &html.Node{
+		Type:      node.Type,
+		DataAtom:  node.DataAtom,
+		Data:      node.Data,
+		Namespace: node.Namespace,
+		Attr:      append([]html.Attribute{}, node.Attr...),
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		result.AppendChild(cloneNode(child))
+	}
+
+	return result
+}
+
+func cloneNodes(nodes []*html.Node) []*html.Node {
+	result := make([]*html.Node, 0, len(nodes))
+
+	for _, node := range nodes {
+		result = append(result, cloneNode(node))
+	}
+
+	return result
+}
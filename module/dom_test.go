@@ -0,0 +1,116 @@
+package module
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const benchmarkComponents = 20
+
+// multiFragmentPage returns a source response with several components,
+// stylesheets and scripts, like a fragment service serving a whole page.
+func multiFragmentPage() string {
+	var b strings.Builder
+
+	b.WriteString("<html><head>")
+
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&b, `<link rel="stylesheet" href="/style-%d.css">`, i)
+	}
+
+	b.WriteString("</head><body>")
+
+	for i := 0; i < benchmarkComponents; i++ {
+		fmt.Fprintf(&b, `<div data-webc-name="component-%d"><ul>`, i)
+
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(&b, `<li class="item"><a href="/item/%d">Item <b>%d</b></a></li>`, j, j)
+		}
+
+		b.WriteString("</ul></div>")
+	}
+
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&b, `<script src="/script-%d.js"></script>`, i)
+	}
+
+	b.WriteString("</body></html>")
+	return b.String()
+}
+
+func TestCloneNodeIsDetached(t *testing.T) {
+	content := multiFragmentPage()
+	parsed, err := parseSource(&content)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed.components) != benchmarkComponents || len(parsed.stylesheets) != 5 || len(parsed.scripts) != 5 {
+		t.Fatalf("parsed %d components, %d stylesheets and %d scripts", len(parsed.components), len(parsed.stylesheets), len(parsed.scripts))
+	}
+
+	original := parsed.components["component-0"]
+	expected, _ := renderToString(original)
+	clone := cloneNode(original)
+
+	if clone.Parent != nil || clone.NextSibling != nil || clone.PrevSibling != nil {
+		t.Fatal("clone is attached to the document")
+	}
+
+	rendered, _ := renderToString(clone)
+
+	if *rendered != *expected {
+		t.Fatalf("clone renders %q, expected %q", *rendered, *expected)
+	}
+
+	clone.Attr[0].Val = "changed"
+	clone.RemoveChild(clone.FirstChild)
+	after, _ := renderToString(original)
+
+	if *after != *expected {
+		t.Fatalf("changing the clone changed the original to %q", *after)
+	}
+}
+
+// BenchmarkParseComponents parses the response for every component, as
+// each page did before the parsed source was shared.
+func BenchmarkParseComponents(b *testing.B) {
+	content := multiFragmentPage()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for c := 0; c < benchmarkComponents; c++ {
+			parsed, err := parseSource(&content)
+
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			_ = parsed.components[fmt.Sprint("component-", c)]
+		}
+	}
+}
+
+// BenchmarkCloneComponents clones the components of a response parsed
+// once, as the pages do now.
+func BenchmarkCloneComponents(b *testing.B) {
+	content := multiFragmentPage()
+	parsed, err := parseSource(&content)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for c := 0; c < benchmarkComponents; c++ {
+			_ = cloneNode(parsed.components[fmt.Sprint("component-", c)])
+			_ = cloneNodes(parsed.stylesheets)
+			_ = cloneNodes(parsed.scripts)
+		}
+	}
+}
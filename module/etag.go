@@ -0,0 +1,157 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The ETag is a hash of the composed bytes.
+	ETagContent = "content"
+	// The ETag is a hash of the page ETag and the validators of the
+	// components, falling back to the content when one is missing.
+	ETagValidators = "validators"
+)
+
+// setValidators sets the ETag and Last-Modified of the composed page and
+// reports whether the request conditions match them, in which case a 304
+// must be sent instead of the body.
+func (ctx *ComposeContext) setValidators(header http.Header, content []byte, statusCode int) bool {
+	pageETag := header.Get("Etag")
+	pageLastModified := header.Get("Last-Modified")
+
+	header.Del("Etag")
+	header.Del("Last-Modified")
+
+	if statusCode != http.StatusOK && statusCode != 0 {
+		return false
+	}
+
+	etag := ""
+
+	if ctx.webComposer.ETag == ETagValidators && !ctx.isDebugEnabled() {
+		etag = validatorsETag(pageETag, ctx.sources)
+	}
+
+	if etag == "" {
+		etag = hashETag(content)
+	}
+
+	header.Set("Etag", etag)
+
+	lastModified, known := newestLastModified(pageLastModified, ctx.sources)
+
+	if known {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	method := ctx.httpRequest.Method
+
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+
+	return etagMatches(ctx.httpRequest.Header.Get("If-None-Match"), etag)
+}
+
+func hashETag(parts ...[]byte) string {
+	hasher := sha256.New()
+
+	for _, part := range parts {
+		hasher.Write(part)
+	}
+
+	return `"` + base64.RawURLEncoding.EncodeToString(hasher.Sum(nil)) + `"`
+}
+
+func validatorsETag(pageETag string, sources map[string]*WebSource) string {
+	if pageETag == "" || strings.HasPrefix(pageETag, "W/") {
+		return ""
+	}
+
+	ids := make([]string, 0, len(sources))
+
+	for id := range sources {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	parts := [][]byte{[]byte(pageETag)}
+
+	for _, id := range ids {
+		validator := sources[id].validator()
+
+		if validator == "" {
+			return ""
+		}
+
+		parts = append(parts, []byte("-"+id+"-"+validator))
+	}
+
+	return hashETag(parts...)
+}
+
+// validator returns the strong ETag of the source response, or its
+// Last-Modified when it has none.
+func (s *WebSource) validator() string {
+	if s.responseHeaders == nil {
+		return ""
+	}
+
+	etag := s.responseHeaders.Get("Etag")
+
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return s.responseHeaders.Get("Last-Modified")
+}
+
+// newestLastModified returns the newest Last-Modified of the page and the
+// components, only known when all of them have one.
+func newestLastModified(pageLastModified string, sources map[string]*WebSource) (time.Time, bool) {
+	newest, err := http.ParseTime(pageLastModified)
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for _, source := range sources {
+		if source.responseHeaders == nil {
+			return time.Time{}, false
+		}
+
+		lastModified, err := http.ParseTime(source.responseHeaders.Get("Last-Modified"))
+
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		if lastModified.After(newest) {
+			newest = lastModified
+		}
+	}
+
+	return newest, true
+}
+
+// etagMatches implements the weak comparison If-None-Match requires.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
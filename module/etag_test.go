@@ -0,0 +1,140 @@
+package module
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		matches     bool
+	}{
+		{``, false},
+		{`"a"`, true},
+		{`"b"`, false},
+		{`W/"a"`, true},
+		{`"b", "a"`, true},
+		{`"b","c"`, false},
+		{` W/"b" , W/"a" `, true},
+		{`*`, true},
+		{`a`, false},
+	}
+
+	for _, test := range tests {
+		if got := etagMatches(test.ifNoneMatch, `"a"`); got != test.matches {
+			t.Errorf("etagMatches(%q) %t, expected %t", test.ifNoneMatch, got, test.matches)
+		}
+	}
+}
+
+func TestValidatorsETag(t *testing.T) {
+	component := func(header http.Header) map[string]*WebSource {
+		method, url := GET, "https://example.org/a"
+		source := newSource(&method, &url, nil)
+		source.responseHeaders = &header
+		return map[string]*WebSource{*source.id: source}
+	}
+
+	strong := component(http.Header{"Etag": {`"c1"`}})
+	lastModified := component(http.Header{"Etag": {`W/"c1"`}, "Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}})
+
+	tests := []struct {
+		name     string
+		page     string
+		sources  map[string]*WebSource
+		expected string
+	}{
+		{"strong", `"p1"`, strong, validatorsETag(`"p1"`, strong)},
+		{"weak page", `W/"p1"`, strong, ""},
+		{"no page etag", "", strong, ""},
+		{"weak component", `"p1"`, component(http.Header{"Etag": {`W/"c1"`}}), ""},
+		{"no component validator", `"p1"`, component(http.Header{}), ""},
+		{"component last modified", `"p1"`, lastModified, validatorsETag(`"p1"`, lastModified)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := validatorsETag(test.page, test.sources); got != test.expected {
+				t.Errorf("etag %q, expected %q", got, test.expected)
+			}
+		})
+	}
+
+	if validatorsETag(`"p1"`, strong) == validatorsETag(`"p2"`, strong) {
+		t.Error("etag not changed with the page one")
+	}
+
+	if validatorsETag(`"p1"`, strong) == validatorsETag(`"p1"`, component(http.Header{"Etag": {`"c2"`}})) {
+		t.Error("etag not changed with the component one")
+	}
+
+	if validatorsETag(`"p1"`, lastModified) == validatorsETag(`"p1"`, strong) {
+		t.Error("weak component etag used")
+	}
+}
+
+func TestServeETag(t *testing.T) {
+	fragments := fragmentServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Etag", `"c1"`)
+		_, _ = rw.Write([]byte(`<div data-webc-name="x">X</div>`))
+	})
+
+	page := `<html><head></head><body>` + placeholderDiv(fragments.URL, "x") + `</body></html>`
+	composed := `<html><head></head><body><div data-webc-name="x">X</div></body></html>`
+
+	tests := []struct {
+		name     string
+		mode     string
+		pageETag string
+		expected string
+	}{
+		{"content", ETagContent, `"p1"`, hashETag([]byte(composed))},
+		{"validators", ETagValidators, `"p1"`, ""},
+		{"validators of a weak page etag", ETagValidators, `W/"p1"`, hashETag([]byte(composed))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := newTestComposer(t, &WebComposer{ETag: test.mode})
+			next := pageHandler(http.Header{"Etag": {test.pageETag}}, page)
+
+			response := serve(t, w, httptest.NewRequest(http.MethodGet, "/page", nil), next)
+			etag := response.Header().Get("Etag")
+
+			if response.Code != http.StatusOK || response.Body.String() != composed {
+				t.Fatalf("status %d, body %s", response.Code, response.Body.String())
+			}
+
+			if etag == "" || etag == test.pageETag || (test.expected != "" && etag != test.expected) {
+				t.Fatalf("etag %q, expected %q", etag, test.expected)
+			}
+
+			for _, ifNoneMatch := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+				request := httptest.NewRequest(http.MethodGet, "/page", nil)
+				request.Header.Set("If-None-Match", ifNoneMatch)
+				response := serve(t, w, request, next)
+
+				if response.Code != http.StatusNotModified {
+					t.Errorf("If-None-Match %s: status %d", ifNoneMatch, response.Code)
+				}
+
+				if response.Body.Len() > 0 || response.Header().Get("Content-Length") != "" {
+					t.Errorf("If-None-Match %s: body %q, length %q", ifNoneMatch, response.Body.String(), response.Header().Get("Content-Length"))
+				}
+
+				if response.Header().Get("Etag") != etag {
+					t.Errorf("If-None-Match %s: etag %q", ifNoneMatch, response.Header().Get("Etag"))
+				}
+			}
+
+			request := httptest.NewRequest(http.MethodGet, "/page", nil)
+			request.Header.Set("If-None-Match", `"other"`)
+
+			if response := serve(t, w, request, next); response.Code != http.StatusOK {
+				t.Errorf("other etag: status %d", response.Code)
+			}
+		})
+	}
+}
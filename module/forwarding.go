@@ -0,0 +1,235 @@
+package module
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/publicsuffix"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var credentialHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+}
+
+// HeaderForwarding decides which headers of the page request are sent to
+// a component url. Without a matching rule the X-* headers and the
+// credentials only reach hosts of the page own domain, as X-* headers like
+// X-Api-Key carry credentials too.
+type HeaderForwarding struct {
+	// Host patterns the rule applies to, like *.example.com. Only used by
+	// the rules of the composer, service rules apply to the service.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Header names forwarded, with wildcards like X-*.
+	Allow []string `json:"allow,omitempty"`
+
+	// Regular expressions matched against the forwarded header names.
+	AllowRegexp []string `json:"allow_regexp,omitempty"`
+
+	// Header names never forwarded, even if allowed.
+	Deny []string `json:"deny,omitempty"`
+
+	// Cookies sent when the Cookie header is forwarded, all when empty.
+	Cookies []string `json:"cookies,omitempty"`
+
+	// Headers renamed when forwarded, from page name to component name.
+	Rename map[string]string `json:"rename,omitempty"`
+
+	// Static headers set on the component request.
+	Set map[string]string `json:"set,omitempty"`
+
+	allowRegexp []*regexp.Regexp
+}
+
+func (f *HeaderForwarding) provision() error {
+	f.allowRegexp = nil
+
+	for _, expression := range f.AllowRegexp {
+		compiled, err := regexp.Compile("(?i)" + expression)
+
+		if err != nil {
+			return errors.Wrapf(err, "Invalid header expression %s", expression)
+		}
+
+		f.allowRegexp = append(f.allowRegexp, compiled)
+	}
+
+	return nil
+}
+
+func (f *HeaderForwarding) matchesHost(host string) bool {
+	for _, pattern := range f.Hosts {
+		matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *HeaderForwarding) isAllowed(key string) bool {
+	if matchesHeaderName(f.Deny, key) {
+		return false
+	}
+
+	if matchesHeaderName(f.Allow, key) {
+		return true
+	}
+
+	for _, expression := range f.allowRegexp {
+		if expression.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *HeaderForwarding) rename(key string) string {
+	for from, to := range f.Rename {
+		if strings.EqualFold(from, key) {
+			return to
+		}
+	}
+	return key
+}
+
+func (f *HeaderForwarding) filterCookies(values []string) []string {
+	if len(f.Cookies) == 0 {
+		return values
+	}
+
+	var cookies []string
+
+	for _, value := range values {
+		for _, cookie := range strings.Split(value, ";") {
+			cookie = strings.TrimSpace(cookie)
+			name, _, _ := strings.Cut(cookie, "=")
+
+			if containsString(f.Cookies, name) {
+				cookies = append(cookies, cookie)
+			}
+		}
+	}
+
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	return []string{strings.Join(cookies, "; ")}
+}
+
+func matchesHeaderName(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(key))
+
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// headerForwarding returns the rule applied to a request sent to the host,
+// nil when the default policy must be used.
+func (w *WebComposer) headerForwarding(service *Service, host string) *HeaderForwarding {
+	if service != nil && service.HeaderForwarding != nil {
+		return service.HeaderForwarding
+	}
+
+	if service == nil {
+		for _, rule := range w.HeaderForwarding {
+			if rule.matchesHost(host) {
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ctx *ComposeContext) handoverRequestHeader(request *http.Request, service *Service) {
+	rule := ctx.webComposer.headerForwarding(service, request.URL.Hostname())
+	sameSite := isSameSite(ctx.httpRequest.Host, request.URL.Hostname())
+
+	for key, values := range ctx.httpRequest.Header {
+		name := key
+
+		if rule != nil {
+			if !rule.isAllowed(key) {
+				continue
+			}
+
+			if strings.EqualFold(key, "Cookie") {
+				values = rule.filterCookies(values)
+			}
+
+			name = rule.rename(key)
+		} else if !isDefaultForwardedHeader(key, sameSite) {
+			continue
+		}
+
+		for _, value := range values {
+			if !containsHeaderValue(request.Header, name, value) {
+				request.Header.Add(name, value)
+			}
+		}
+	}
+
+	if rule != nil {
+		for key, value := range rule.Set {
+			request.Header.Set(key, value)
+		}
+	}
+}
+
+func isDefaultForwardedHeader(key string, sameSite bool) bool {
+	if !sameSite {
+		return false
+	}
+
+	for _, credential := range credentialHeaders {
+		if strings.EqualFold(credential, key) {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, "X-")
+}
+
+// isSameSite reports whether the component host belongs to the same
+// registrable domain as the page host.
+func isSameSite(pageHost string, componentHost string) bool {
+	if host, _, err := net.SplitHostPort(pageHost); err == nil {
+		pageHost = host
+	}
+
+	pageHost = strings.ToLower(pageHost)
+	componentHost = strings.ToLower(componentHost)
+
+	if pageHost == componentHost {
+		return true
+	}
+
+	if net.ParseIP(pageHost) != nil || net.ParseIP(componentHost) != nil {
+		return false
+	}
+
+	pageDomain, err := publicsuffix.EffectiveTLDPlusOne(pageHost)
+
+	if err != nil {
+		return false
+	}
+
+	componentDomain, err := publicsuffix.EffectiveTLDPlusOne(componentHost)
+
+	if err != nil {
+		return false
+	}
+
+	return pageDomain == componentDomain
+}
@@ -0,0 +1,174 @@
+package module
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestIsSameSite(t *testing.T) {
+	tests := []struct {
+		page      string
+		component string
+		sameSite  bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com:8443", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"www.example.com", "api.example.com", true},
+		{"example.com", "cdn.example.com", true},
+		{"example.co.uk", "api.example.co.uk", true},
+		{"example.com", "example.org", false},
+		{"example.com", "example.com.evil.org", false},
+		{"example.co.uk", "other.co.uk", false},
+		{"alice.github.io", "bob.github.io", false},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"127.0.0.1:8080", "127.0.0.1", true},
+		{"127.0.0.1", "127.0.0.2", false},
+		{"example.com", "93.184.216.34", false},
+		{"localhost", "api.localhost", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.page+" "+test.component, func(t *testing.T) {
+			if sameSite := isSameSite(test.page, test.component); sameSite != test.sameSite {
+				t.Errorf("isSameSite(%s, %s) = %v, expected %v", test.page, test.component, sameSite, test.sameSite)
+			}
+		})
+	}
+}
+
+func TestHandoverRequestHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []*HeaderForwarding
+		service   *Service
+		component string
+		expected  http.Header
+	}{
+		{
+			name:      "default same site",
+			component: "https://api.example.com/a",
+			expected: http.Header{
+				"Authorization": {"Bearer token"},
+				"Cookie":        {"session=1; theme=dark"},
+				"X-Api-Key":     {"secret"},
+				"X-Request-Id":  {"42"},
+			},
+		},
+		{
+			name:      "default other site",
+			component: "https://example.org/a",
+			expected:  http.Header{},
+		},
+		{
+			name: "host rule",
+			rules: []*HeaderForwarding{{
+				Hosts:   []string{"*.example.org"},
+				Allow:   []string{"Cookie", "Accept-*"},
+				Cookies: []string{"theme"},
+				Rename:  map[string]string{"Accept-Language": "X-Locale"},
+				Set:     map[string]string{"X-Composer": "1"},
+			}},
+			component: "https://cdn.example.org/a",
+			expected: http.Header{
+				"Cookie":     {"theme=dark"},
+				"X-Locale":   {"en"},
+				"X-Composer": {"1"},
+			},
+		},
+		{
+			name: "host rule not matching",
+			rules: []*HeaderForwarding{{
+				Hosts: []string{"*.example.org"},
+				Allow: []string{"*"},
+			}},
+			component: "https://example.net/a",
+			expected:  http.Header{},
+		},
+		{
+			name: "deny over allow",
+			rules: []*HeaderForwarding{{
+				Hosts:       []string{"example.org"},
+				AllowRegexp: []string{"^x-"},
+				Allow:       []string{"Authorization"},
+				Deny:        []string{"Authorization", "X-Request-*"},
+			}},
+			component: "https://example.org/a",
+			expected: http.Header{
+				"X-Api-Key": {"secret"},
+			},
+		},
+		{
+			name: "service rule over host rules",
+			rules: []*HeaderForwarding{{
+				Hosts: []string{"*"},
+				Allow: []string{"*"},
+			}},
+			service: &Service{HeaderForwarding: &HeaderForwarding{
+				Allow: []string{"Authorization"},
+			}},
+			component: "https://example.org/a",
+			expected: http.Header{
+				"Authorization": {"Bearer token"},
+			},
+		},
+		{
+			name: "host rules ignored by services",
+			rules: []*HeaderForwarding{{
+				Hosts: []string{"*"},
+				Allow: []string{"*"},
+			}},
+			service:   &Service{},
+			component: "https://example.org/a",
+			expected:  http.Header{},
+		},
+		{
+			name: "no cookie left",
+			rules: []*HeaderForwarding{{
+				Hosts:   []string{"example.org"},
+				Allow:   []string{"Cookie"},
+				Cookies: []string{"cart"},
+			}},
+			component: "https://example.org/a",
+			expected:  http.Header{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, rule := range test.rules {
+				if err := rule.provision(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.service != nil && test.service.HeaderForwarding != nil {
+				if err := test.service.HeaderForwarding.provision(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			page := httptest.NewRequest(GET, "https://www.example.com/page", nil)
+			page.Header.Set("Authorization", "Bearer token")
+			page.Header.Set("Cookie", "session=1; theme=dark")
+			page.Header.Set("Accept-Language", "en")
+			page.Header.Set("X-Request-Id", "42")
+			page.Header.Set("X-Api-Key", "secret")
+
+			ctx := &ComposeContext{
+				webComposer: &WebComposer{HeaderForwarding: test.rules},
+				httpRequest: page,
+			}
+
+			request := httptest.NewRequest(GET, test.component, nil)
+			request.Header = make(http.Header)
+			ctx.handoverRequestHeader(request, test.service)
+
+			if !reflect.DeepEqual(request.Header, test.expected) {
+				t.Errorf("forwarded %v, expected %v", request.Header, test.expected)
+			}
+		})
+	}
+}
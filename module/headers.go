@@ -0,0 +1,212 @@
+package module
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// The header is removed from the composed response.
+	MergeIgnore = "ignore"
+	// The first value set, by the page or a component, is kept.
+	MergeFirst = "first"
+	// Only the value set by the page is kept.
+	MergePrimary = "primary"
+	// Every value of every component is added.
+	MergeAppend = "append"
+	// The values of the components not already present are added.
+	MergeUnion = "union"
+)
+
+const (
+	// Cookies already set by the page or a previous component are kept.
+	CookieConflictFirst = "first"
+	// Cookies of the components replace the ones already set.
+	CookieConflictLast = "last"
+)
+
+// Headers that only make sense on requests and are never copied from a
+// component response to the page.
+var requestOnlyHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Host",
+	"Proxy-Authorization",
+}
+
+// Headers that must not be overridden by components even if they match
+// the X-* default rule.
+var defaultResponseHeaderRules = map[string]string{
+	"Content-Security-Policy":   MergePrimary,
+	"Strict-Transport-Security": MergePrimary,
+	"X-Content-Type-Options":    MergePrimary,
+	"X-Frame-Options":           MergePrimary,
+	"X-Xss-Protection":          MergePrimary,
+}
+
+// ResponseHeaders decides how the headers of the component responses are
+// merged into the page response.
+type ResponseHeaders struct {
+	// Merge mode per header name: ignore, first, primary, append or union.
+	Rules map[string]string `json:"rules,omitempty"`
+
+	// Mode of the X-* headers without a rule, union when empty. Any other
+	// header without a rule is primary.
+	Default string `json:"default,omitempty"`
+
+	// Resolution of Set-Cookie headers with the same name, path and domain:
+	// first (default) or last.
+	CookieConflict string `json:"cookie_conflict,omitempty"`
+
+	rules map[string]string
+}
+
+func (r *ResponseHeaders) provision() error {
+	if r.Default == "" {
+		r.Default = MergeUnion
+	}
+
+	if r.CookieConflict == "" {
+		r.CookieConflict = CookieConflictFirst
+	}
+
+	if r.CookieConflict != CookieConflictFirst && r.CookieConflict != CookieConflictLast {
+		return errors.Errorf("Unknown cookie conflict resolution %s", r.CookieConflict)
+	}
+
+	r.rules = make(map[string]string)
+
+	for key, mode := range defaultResponseHeaderRules {
+		r.rules[key] = mode
+	}
+
+	for key, mode := range r.Rules {
+		r.rules[http.CanonicalHeaderKey(key)] = mode
+	}
+
+	for key, mode := range r.rules {
+		err := validateMergeMode(mode)
+
+		if err != nil {
+			return errors.Wrapf(err, "Header %s", key)
+		}
+	}
+
+	return validateMergeMode(r.Default)
+}
+
+func validateMergeMode(mode string) error {
+	switch mode {
+	case MergeIgnore, MergeFirst, MergePrimary, MergeAppend, MergeUnion:
+		return nil
+	default:
+		return errors.Errorf("Unknown merge mode %s", mode)
+	}
+}
+
+func (r *ResponseHeaders) mode(key string) string {
+	mode, found := r.rules[http.CanonicalHeaderKey(key)]
+
+	if found {
+		return mode
+	}
+
+	if strings.HasPrefix(http.CanonicalHeaderKey(key), "X-") {
+		return r.Default
+	}
+
+	if strings.EqualFold(key, "Set-Cookie") {
+		return MergeUnion
+	}
+
+	return MergePrimary
+}
+
+// merge copies the headers of a component response into the page ones.
+func (r *ResponseHeaders) merge(page http.Header, component http.Header) {
+	for key, values := range component {
+		if containsHeaderName(requestOnlyHeaders, key) {
+			continue
+		}
+
+		switch r.mode(key) {
+		case MergeFirst:
+			if len(page.Values(key)) == 0 {
+				for _, value := range values {
+					page.Add(key, value)
+				}
+			}
+		case MergeAppend, MergeUnion:
+			if strings.EqualFold(key, "Set-Cookie") {
+				r.mergeCookies(page, values)
+				continue
+			}
+
+			for _, value := range values {
+				if r.mode(key) == MergeAppend || !containsHeaderValue(page, key, value) {
+					page.Add(key, value)
+				}
+			}
+		}
+	}
+}
+
+// finish removes the ignored headers once every component is merged.
+func (r *ResponseHeaders) finish(page http.Header) {
+	for key := range page {
+		if r.mode(key) == MergeIgnore {
+			page.Del(key)
+		}
+	}
+}
+
+// mergeCookies adds the Set-Cookie values of a component, resolving the
+// cookies that collide by name, path and domain.
+func (r *ResponseHeaders) mergeCookies(page http.Header, values []string) {
+	for _, value := range values {
+		key := cookieKey(value)
+
+		if key == "" {
+			continue
+		}
+
+		existing := page.Values("Set-Cookie")
+		index := -1
+
+		for i, current := range existing {
+			if cookieKey(current) == key {
+				index = i
+				break
+			}
+		}
+
+		if index < 0 {
+			page.Add("Set-Cookie", value)
+		} else if r.CookieConflict == CookieConflictLast {
+			merged := append([]string{}, existing...)
+			merged[index] = value
+			page["Set-Cookie"] = merged
+		}
+	}
+}
+
+func cookieKey(value string) string {
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {value}}}).Cookies()
+
+	if len(cookies) == 0 {
+		return ""
+	}
+
+	cookie := cookies[0]
+	return cookie.Name + ";" + cookie.Path + ";" + strings.TrimPrefix(strings.ToLower(cookie.Domain), ".")
+}
+
+func containsHeaderName(names []string, key string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, key) {
+			return true
+		}
+	}
+	return false
+}
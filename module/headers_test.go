@@ -0,0 +1,165 @@
+package module
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestResponseHeadersMerge(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     ResponseHeaders
+		page       http.Header
+		components []http.Header
+		expected   http.Header
+	}{
+		{
+			name:       "primary by default",
+			page:       http.Header{"Link": {"</page.css>"}},
+			components: []http.Header{{"Link": {"</c.css>"}, "Content-Language": {"en"}}},
+			expected:   http.Header{"Link": {"</page.css>"}},
+		},
+		{
+			name:       "x headers union by default",
+			page:       http.Header{"X-Served-By": {"page"}},
+			components: []http.Header{{"X-Served-By": {"page", "a"}}, {"X-Served-By": {"a", "b"}}},
+			expected:   http.Header{"X-Served-By": {"page", "a", "b"}},
+		},
+		{
+			name:       "x headers default mode",
+			config:     ResponseHeaders{Default: MergeAppend},
+			page:       http.Header{"X-Served-By": {"page"}},
+			components: []http.Header{{"X-Served-By": {"page"}}},
+			expected:   http.Header{"X-Served-By": {"page", "page"}},
+		},
+		{
+			name:       "security headers kept from the page",
+			page:       http.Header{"X-Frame-Options": {"DENY"}},
+			components: []http.Header{{"X-Frame-Options": {"ALLOW"}, "Content-Security-Policy": {"default-src *"}}},
+			expected:   http.Header{"X-Frame-Options": {"DENY"}},
+		},
+		{
+			name:       "request headers never copied",
+			config:     ResponseHeaders{Rules: map[string]string{"Authorization": MergeAppend}},
+			page:       http.Header{},
+			components: []http.Header{{"Authorization": {"Bearer token"}, "Cookie": {"a=1"}}},
+			expected:   http.Header{},
+		},
+		{
+			name:       "first value",
+			config:     ResponseHeaders{Rules: map[string]string{"content-language": MergeFirst}},
+			page:       http.Header{},
+			components: []http.Header{{"Content-Language": {"en", "de"}}, {"Content-Language": {"fr"}}},
+			expected:   http.Header{"Content-Language": {"en", "de"}},
+		},
+		{
+			name:       "first value of the page",
+			config:     ResponseHeaders{Rules: map[string]string{"Content-Language": MergeFirst}},
+			page:       http.Header{"Content-Language": {"es"}},
+			components: []http.Header{{"Content-Language": {"fr"}}},
+			expected:   http.Header{"Content-Language": {"es"}},
+		},
+		{
+			name:       "append",
+			config:     ResponseHeaders{Rules: map[string]string{"Link": MergeAppend}},
+			page:       http.Header{"Link": {"</page.css>"}},
+			components: []http.Header{{"Link": {"</c.css>"}}, {"Link": {"</c.css>"}}},
+			expected:   http.Header{"Link": {"</page.css>", "</c.css>", "</c.css>"}},
+		},
+		{
+			name:       "union",
+			config:     ResponseHeaders{Rules: map[string]string{"Link": MergeUnion}},
+			page:       http.Header{"Link": {"</page.css>"}},
+			components: []http.Header{{"Link": {"</c.css>", "</page.css>"}}, {"Link": {"</c.css>"}}},
+			expected:   http.Header{"Link": {"</page.css>", "</c.css>"}},
+		},
+		{
+			name:       "ignore",
+			config:     ResponseHeaders{Rules: map[string]string{"X-Debug": MergeIgnore}},
+			page:       http.Header{"X-Debug": {"page"}, "X-Other": {"1"}},
+			components: []http.Header{{"X-Debug": {"a"}}},
+			expected:   http.Header{"X-Other": {"1"}},
+		},
+		{
+			name:       "new cookies added",
+			page:       http.Header{"Set-Cookie": {"a=page"}},
+			components: []http.Header{{"Set-Cookie": {"b=1", "c=1"}}},
+			expected:   http.Header{"Set-Cookie": {"a=page", "b=1", "c=1"}},
+		},
+		{
+			name:       "first cookie kept",
+			page:       http.Header{"Set-Cookie": {"a=page; Path=/"}},
+			components: []http.Header{{"Set-Cookie": {"a=1; Path=/"}}, {"Set-Cookie": {"a=2; Path=/"}}},
+			expected:   http.Header{"Set-Cookie": {"a=page; Path=/"}},
+		},
+		{
+			name:       "last cookie kept",
+			config:     ResponseHeaders{CookieConflict: CookieConflictLast},
+			page:       http.Header{"Set-Cookie": {"a=page; Path=/", "b=page"}},
+			components: []http.Header{{"Set-Cookie": {"a=1; Path=/"}}, {"Set-Cookie": {"a=2; Path=/"}}},
+			expected:   http.Header{"Set-Cookie": {"a=2; Path=/", "b=page"}},
+		},
+		{
+			name:       "conflict within a component",
+			page:       http.Header{},
+			components: []http.Header{{"Set-Cookie": {"a=1", "a=2"}}},
+			expected:   http.Header{"Set-Cookie": {"a=1"}},
+		},
+		{
+			name:   "same name on other paths and domains",
+			config: ResponseHeaders{CookieConflict: CookieConflictLast},
+			page:   http.Header{"Set-Cookie": {"a=page; Path=/; Domain=.example.com"}},
+			components: []http.Header{{"Set-Cookie": {
+				"a=1; Path=/shop; Domain=example.com",
+				"a=2; Path=/; Domain=shop.example.com",
+				"a=3; Path=/; Domain=EXAMPLE.com",
+			}}},
+			expected: http.Header{"Set-Cookie": {
+				"a=3; Path=/; Domain=EXAMPLE.com",
+				"a=1; Path=/shop; Domain=example.com",
+				"a=2; Path=/; Domain=shop.example.com",
+			}},
+		},
+		{
+			name:       "unparseable cookies dropped",
+			page:       http.Header{},
+			components: []http.Header{{"Set-Cookie": {"", "=nameless", "a b=1", "a=1"}}},
+			expected:   http.Header{"Set-Cookie": {"a=1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+
+			if err := config.provision(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, component := range test.components {
+				config.merge(test.page, component)
+			}
+
+			config.finish(test.page)
+
+			if !reflect.DeepEqual(test.page, test.expected) {
+				t.Errorf("page headers %v, expected %v", test.page, test.expected)
+			}
+		})
+	}
+}
+
+func TestResponseHeadersProvisionErrors(t *testing.T) {
+	configs := []ResponseHeaders{
+		{Rules: map[string]string{"Link": "merge"}},
+		{Default: "last"},
+		{CookieConflict: "union"},
+	}
+
+	for _, config := range configs {
+		if err := config.provision(); err == nil {
+			t.Errorf("%+v provisioned", config)
+		}
+	}
+}
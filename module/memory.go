@@ -0,0 +1,165 @@
+package module
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryCache bounds the memory tier of the global cache. The cache keys
+// may depend on the request headers and cookies, so without bounds the
+// cache would grow with the users.
+type MemoryCache struct {
+	// Maximum number of entries, 10000 when zero.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// Maximum size of the contents in bytes, 256MiB when zero.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// Time an expired entry is kept to be served as stale copy, 1h when
+	// zero.
+	MaxStale caddy.Duration `json:"max_stale,omitempty"`
+
+	// Time between two sweeps of the expired entries, 1m when zero.
+	SweepInterval caddy.Duration `json:"sweep_interval,omitempty"`
+}
+
+func (m *MemoryCache) provision() {
+	if m.MaxEntries <= 0 {
+		m.MaxEntries = 10000
+	}
+
+	if m.MaxBytes <= 0 {
+		m.MaxBytes = 256 << 20
+	}
+
+	if m.MaxStale <= 0 {
+		m.MaxStale = caddy.Duration(time.Hour)
+	}
+
+	if m.SweepInterval <= 0 {
+		m.SweepInterval = caddy.Duration(time.Minute)
+	}
+}
+
+// startSweeper removes the expired entries periodically until the cache is
+// destructed.
+func (c *Cache) startSweeper() {
+	c.stop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.limits.SweepInterval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.sweep(time.Now())
+			}
+		}
+	}()
+}
+
+func (c *Cache) stopSweeper() {
+	if c.stop != nil {
+		close(c.stop)
+	}
+}
+
+// sweep drops the entries expired for longer than the max stale time, the
+// expired missing components and the Vary learned for sources no longer in
+// memory, learned again on their next load. The disk tier keeps its own
+// entries.
+func (c *Cache) sweep(now time.Time) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	limit := now.Add(-time.Duration(c.limits.MaxStale))
+
+	removed := 0
+
+	for id, entry := range c.entries {
+		if entry.validUntil != nil && entry.validUntil.Before(limit) {
+			c.evict(id, entry)
+			removed++
+		}
+	}
+
+	for key, until := range c.missing {
+		if now.After(until) {
+			delete(c.missing, key)
+		}
+	}
+
+	cached := make(map[string]struct{}, len(c.entries))
+
+	for _, entry := range c.entries {
+		if entry.source.baseId != nil {
+			cached[*entry.source.baseId] = struct{}{}
+		}
+	}
+
+	for baseId := range c.varies {
+		if _, found := cached[baseId]; !found {
+			delete(c.varies, baseId)
+		}
+	}
+
+	return removed
+}
+
+// enforceLimits evicts the least recently used entries while the cache is
+// over its bounds, down to 90% of them so the next sets do not evict again.
+// The lock must be held.
+func (c *Cache) enforceLimits() {
+	if c.limits == nil {
+		return
+	}
+
+	if len(c.entries) <= c.limits.MaxEntries && c.bytes <= c.limits.MaxBytes {
+		return
+	}
+
+	type candidate struct {
+		id       string
+		entry    *CacheEntry
+		lastUsed int64
+	}
+
+	candidates := make([]candidate, 0, len(c.entries))
+
+	for id, entry := range c.entries {
+		candidates = append(candidates, candidate{id: id, entry: entry, lastUsed: atomic.LoadInt64(&entry.lastUsed)})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed < candidates[j].lastUsed
+	})
+
+	maxEntries := c.limits.MaxEntries * 9 / 10
+	maxBytes := c.limits.MaxBytes * 9 / 10
+
+	for _, candidate := range candidates {
+		if len(c.entries) <= maxEntries && c.bytes <= maxBytes {
+			break
+		}
+
+		c.evict(candidate.id, candidate.entry)
+	}
+}
+
+// evict drops the entry from memory only, the pages composed with it are
+// still valid. The lock must be held.
+func (c *Cache) evict(id string, entry *CacheEntry) {
+	c.untag(id, entry)
+	c.account(entry, -1)
+	delete(c.entries, id)
+	c.countEviction()
+}
+
+func (e *CacheEntry) touch() {
+	atomic.StoreInt64(&e.lastUsed, time.Now().UnixNano())
+}
@@ -0,0 +1,176 @@
+package module
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "caddy"
+const metricsSubsystem = "web_composer"
+
+// Label of the fragments not fetched through a service, their hosts would
+// make the cardinality unbounded.
+const noServiceLabel = "none"
+
+var composerMetrics = struct {
+	init                sync.Once
+	retries             *prometheus.CounterVec
+	hedgedRequests      *prometheus.CounterVec
+	compositionDuration *prometheus.HistogramVec
+	fetchDuration       *prometheus.HistogramVec
+	fetchResponses      *prometheus.CounterVec
+	fetchesInFlight     *prometheus.GaugeVec
+	fetchTimeouts       *prometheus.CounterVec
+	cacheLookups        *prometheus.CounterVec
+	cacheEvictions      *prometheus.CounterVec
+	cacheEntries        *prometheus.GaugeVec
+	cacheSize           *prometheus.GaugeVec
+	circuitState        *prometheus.GaugeVec
+	fallbacks           *prometheus.CounterVec
+}{}
+
+func initComposerMetrics() {
+	composerMetrics.init.Do(func() {
+		composerMetrics.retries = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fragment_retries_total",
+			Help:      "Counter of fragment requests retried after a transient failure.",
+		}, []string{"service"})
+
+		composerMetrics.hedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fragment_hedged_requests_total",
+			Help:      "Counter of hedged fragment requests sent.",
+		}, []string{"service"})
+
+		composerMetrics.compositionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "composition_duration_seconds",
+			Help:      "Histogram of the time spent composing a page, after the page response.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "mode"})
+
+		composerMetrics.fetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fragment_fetch_duration_seconds",
+			Help:      "Histogram of the fragment request latencies.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service"})
+
+		composerMetrics.fetchResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fragment_responses_total",
+			Help:      "Counter of fragment responses by status class, error when none was received.",
+		}, []string{"service", "status"})
+
+		composerMetrics.fetchesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fragment_requests_in_flight",
+			Help:      "Number of fragment requests being sent.",
+		}, []string{"service"})
+
+		composerMetrics.fetchTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fragment_timeouts_total",
+			Help:      "Counter of fragment requests that timed out.",
+		}, []string{"service"})
+
+		composerMetrics.cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "cache_lookups_total",
+			Help:      "Counter of global cache lookups by result: hit, miss or stale.",
+		}, []string{"cache", "result"})
+
+		composerMetrics.cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "cache_evictions_total",
+			Help:      "Counter of entries deleted from the global cache.",
+		}, []string{"cache"})
+
+		composerMetrics.cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "cache_entries",
+			Help:      "Number of entries kept in memory by the global cache.",
+		}, []string{"cache"})
+
+		composerMetrics.cacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "cache_size_bytes",
+			Help:      "Size of the contents kept in memory by the global cache.",
+		}, []string{"cache"})
+
+		composerMetrics.circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breakers: 0 closed, 1 open, 2 half-open.",
+		}, []string{"breaker"})
+
+		composerMetrics.fallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fallbacks_total",
+			Help:      "Counter of components replaced by a fallback: stale copy or placeholder.",
+		}, []string{"route", "fallback"})
+	})
+}
+
+func serviceLabel(s *WebSource) string {
+	if s.service != nil {
+		return s.service.name
+	}
+	return noServiceLabel
+}
+
+func statusClass(statusCode int, err error) string {
+	if err != nil || statusCode < 100 {
+		return "error"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err)
+}
+
+// defaultName returns a name telling apart the handlers of different routes,
+// derived from their config so it is kept across reloads that do not change
+// it. It must be called before the config is provisioned.
+func (w *WebComposer) defaultName() string {
+	config, err := json.Marshal(w)
+
+	if err != nil {
+		return defaultCacheName
+	}
+
+	sum := sha256.Sum256(config)
+	return "composer-" + hex.EncodeToString(sum[:4])
+}
+
+func (w *WebComposer) observeComposition(mode string, started time.Time) {
+	composerMetrics.compositionDuration.WithLabelValues(w.Name, mode).Observe(time.Since(started).Seconds())
+}
+
+func (w *WebComposer) countFallback(fallback string) {
+	composerMetrics.fallbacks.WithLabelValues(w.Name, fallback).Inc()
+}
@@ -2,15 +2,18 @@ package module
 
 import (
 	"bytes"
+	"context"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 func init() {
@@ -20,9 +23,86 @@ func init() {
 
 // WebComposer is an example; put your own type here.
 type WebComposer struct {
-	logger    *zap.Logger
-	cache     *Cache
-	MIMETypes []string `json:"mime_types,omitempty"`
+	logger       *zap.Logger
+	cache        *Cache
+	hostBreakers *circuitBreakers
+	transport    *http.Transport
+	pageCache    *pageCache
+	MIMETypes    []string `json:"mime_types,omitempty"`
+
+	// Named fragment services, referenced as svc://<name>/<path>.
+	Services map[string]*Service `json:"services,omitempty"`
+
+	// Circuit breaker applied per host to the component urls that do
+	// not belong to a service.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+
+	// Maximum time spent loading the components of a page. Retries are
+	// not attempted beyond it.
+	Budget caddy.Duration `json:"budget,omitempty"`
+
+	// Restrictions on the urls components can be fetched from. Private
+	// networks are denied to plain urls by default.
+	UpstreamPolicy *UpstreamPolicy `json:"upstream_policy,omitempty"`
+
+	// Rules deciding which page request headers reach the hosts of plain
+	// component urls. The first rule matching the host is applied.
+	HeaderForwarding []*HeaderForwarding `json:"header_forwarding,omitempty"`
+
+	// How the headers of the component responses are merged into the
+	// page response.
+	ResponseHeaders *ResponseHeaders `json:"response_headers,omitempty"`
+
+	// Leave the page Cache-Control and Vary untouched instead of combining
+	// them with the components ones.
+	KeepCacheControl bool `json:"keep_cache_control,omitempty"`
+
+	// Strong ETag sent with the composed page, answering If-None-Match
+	// with a 304: content or validators. Disabled when empty.
+	ETag string `json:"etag,omitempty"`
+
+	// Cache of the composed pages, invalidated when one of their
+	// components is refreshed or purged. Disabled when empty.
+	PageCache *PageCache `json:"page_cache,omitempty"`
+
+	// Accept PURGE requests deleting the cached components by their
+	// Surrogate-Key or Cache-Tag. Disabled when empty.
+	Purge *Purge `json:"purge,omitempty"`
+
+	// Second cache tier on disk, kept across restarts. Disabled when empty.
+	DiskCache *DiskCache `json:"disk_cache,omitempty"`
+
+	// Bounds of the memory tier of the global cache.
+	MemoryCache *MemoryCache `json:"memory_cache,omitempty"`
+
+	// Name of the global cache. Handlers with the same name share it, and
+	// it is kept across config reloads. default when empty.
+	CacheName string `json:"cache_name,omitempty"`
+
+	// Name of the handler in the metrics and traces. When empty it is
+	// derived from the handler config, so it changes with it.
+	Name string `json:"name,omitempty"`
+
+	// Add a Server-Timing header with the composition time and the cost of
+	// each component. Not sent with streamed pages, whose headers are
+	// written before the components resolve.
+	ServerTiming bool `json:"server_timing,omitempty"`
+
+	// Cache of the failed responses and missing components. Disabled when
+	// empty.
+	NegativeCache *NegativeCache `json:"negative_cache,omitempty"`
+
+	// Write the page while its components are loaded, in_order to write
+	// them in document order, out_of_order to write them as they resolve.
+	// The component headers are not merged into the page ones, so streamed
+	// pages with placeholders are sent as private, no-store unless
+	// keep_cache_control is set, and they are not kept in the page cache.
+	// Disabled when empty or when an etag mode is set.
+	Streaming string `json:"streaming,omitempty"`
+
+	// Components loaded in background to keep the global cache hot.
+	// Disabled when empty.
+	Warmup *Warmup `json:"warmup,omitempty"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -38,17 +118,139 @@ func (w *WebComposer) Provision(ctx caddy.Context) error {
 	w.logger = ctx.Logger(w) // g.logger is a *zap.Logger
 	w.logger.Info("Starting Web-Composer module")
 
+	if w.Name == "" {
+		w.Name = w.defaultName()
+	}
+
 	if w.MIMETypes == nil {
 		w.MIMETypes = defaultMIMETypes
 	}
 
-	w.cache = w.createCache()
+	initComposerMetrics()
+
+	if w.UpstreamPolicy == nil {
+		w.UpstreamPolicy = new(UpstreamPolicy)
+	}
+
+	err := w.UpstreamPolicy.provision()
+
+	if err != nil {
+		return err
+	}
+
+	w.transport = w.UpstreamPolicy.newGuardedTransport()
+
+	for _, rule := range w.HeaderForwarding {
+		err := rule.provision()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.ResponseHeaders == nil {
+		w.ResponseHeaders = new(ResponseHeaders)
+	}
+
+	err = w.ResponseHeaders.provision()
+
+	if err != nil {
+		return err
+	}
+
+	for name, service := range w.Services {
+		err := service.provision(name)
+
+		if err != nil {
+			return err
+		}
+
+		service.startHealthChecks(ctx, w.logger)
+	}
+
+	if w.CircuitBreaker != nil {
+		err := w.CircuitBreaker.provision()
+
+		if err != nil {
+			return err
+		}
+
+		w.hostBreakers = newCircuitBreakers(w.CircuitBreaker)
+	}
+
+	if w.CacheName == "" {
+		w.CacheName = defaultCacheName
+	}
+
+	if w.MemoryCache == nil {
+		w.MemoryCache = new(MemoryCache)
+	}
+
+	w.MemoryCache.provision()
+
+	if w.DiskCache != nil {
+		w.DiskCache.provision()
+	}
+
+	w.cache, err = w.loadCache()
+
+	if err != nil {
+		return err
+	}
+
+	if w.Purge != nil {
+		err := w.Purge.provision()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.PageCache != nil {
+		w.PageCache.provision()
+		w.pageCache = newPageCache(w.PageCache, w.cache)
+	}
+
+	if w.Warmup != nil {
+		err := w.Warmup.provision()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	w.register()
+	w.startWarmup(ctx)
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (w *WebComposer) Cleanup() error {
+	w.unregister()
+
+	if w.pageCache != nil {
+		w.pageCache.close()
+	}
+
+	if w.cache != nil {
+		_, err := caches.Delete(w.CacheName)
+		return err
+	}
 
 	return nil
 }
 
 // Validate implements caddy.Validator.
 func (w *WebComposer) Validate() error {
+	if w.ETag != "" && w.ETag != ETagContent && w.ETag != ETagValidators {
+		return errors.Errorf("Unknown etag mode %s", w.ETag)
+	}
+
+	if w.Streaming != "" && w.Streaming != StreamingInOrder && w.Streaming != StreamingOutOfOrder {
+		return errors.Errorf("Unknown streaming mode %s", w.Streaming)
+	}
+
 	return nil
 }
 
@@ -69,6 +271,18 @@ func (w WebComposer) ServeHTTP(rw http.ResponseWriter, r *http.Request, next cad
 		}
 		return false
 	}
+	if w.Purge != nil && r.Method == PurgeMethod {
+		return w.servePurge(rw, r)
+	}
+
+	if w.pageCache != nil {
+		served, err := w.pageCache.serve(rw, r)
+
+		if served || err != nil {
+			return err
+		}
+	}
+
 	rec := caddyhttp.NewResponseRecorder(rw, buf, shouldBuf)
 
 	err := next.ServeHTTP(rec, r)
@@ -79,38 +293,96 @@ func (w WebComposer) ServeHTTP(rw http.ResponseWriter, r *http.Request, next cad
 		return nil
 	}
 
-	err = w.composeRequest(rec, r)
+	started := time.Now()
+
+	if w.canStream(rec, r) {
+		composeContext := w.createContext(r, &rec)
+		defer composeContext.close()
+		defer w.observeComposition("streamed", started)
+
+		return w.streamRequest(rw, rec, composeContext)
+	}
+
+	defer w.observeComposition("buffered", started)
+
+	composeContext, err := w.composeRequest(rec, r)
 	if err != nil {
 		return err
 	}
 
+	notModified := false
+
+	// a page without components is passed through as the origin sent it,
+	// with its ranges and validators
+	if composeContext.composed {
+		rec.Header().Del("Accept-Ranges") // we don't know ranges for dynamically-created content
+
+		if w.ETag != "" {
+			notModified = composeContext.setValidators(rec.Header(), buf.Bytes(), rec.Status())
+		} else {
+			rec.Header().Del("Last-Modified") // useless for dynamic content since it's always changing
+
+			// weak etags still cause browsers to rely on it even after a
+			// refresh, so they are only sent when a strong one is enabled
+			rec.Header().Del("Etag")
+		}
+	}
+
 	rec.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
-	rec.Header().Del("Accept-Ranges") // we don't know ranges for dynamically-created content
-	rec.Header().Del("Last-Modified") // useless for dynamic content since it's always changing
 
-	// we don't know a way to quickly generate etag for dynamic content,
-	// and weak etags still cause browsers to rely on it even after a
-	// refresh, so disable them until we find a better way to do this
-	rec.Header().Del("Etag")
+	if w.pageCache != nil {
+		w.pageCache.store(r, rec.Status(), rec.Header(), buf.Bytes(), composeContext.sources)
+	}
+
+	if notModified {
+		rec.Header().Del("Content-Length")
+		rw.WriteHeader(http.StatusNotModified)
+		return nil
+	}
 
 	return rec.WriteResponse()
 }
 
-func (w *WebComposer) composeRequest(rr caddyhttp.ResponseRecorder, r *http.Request) error {
+func (w *WebComposer) composeRequest(rr caddyhttp.ResponseRecorder, r *http.Request) (*ComposeContext, error) {
 	buffer := rr.Buffer()
 
 	composeContext := w.createContext(r, &rr)
+	defer composeContext.close()
 
-	result, err := composeContext.compose(buffer.String())
+	span := composeContext.startSpan("web-composer compose")
+	defer span.End()
 
-	if err != nil {
-		return err
+	started := time.Now()
+
+	if composeContext.isDebugEnabled() || containsMarker(buffer.Bytes()) {
+		result, err := composeContext.compose(buffer.String())
+
+		if err != nil {
+			return nil, err
+		}
+
+		buffer.Reset()
+		_, err = buffer.Write([]byte(*result))
+
+		if err != nil {
+			return nil, err
+		}
+
+		composeContext.composed = true
 	}
 
-	buffer.Reset()
-	_, err = buffer.Write([]byte(*result))
+	w.ResponseHeaders.finish(rr.Header())
+
+	if !w.KeepCacheControl {
+		mergeCacheControl(rr.Header(), composeContext.sources)
+		mergeVary(rr.Header(), composeContext.sources)
+	}
 
-	return err
+	varyCacheKeys(rr.Header(), composeContext.sources)
+
+	composeContext.timings.write(rr.Header(), time.Since(started))
+
+	return composeContext, nil
 }
 
 func (w *WebComposer) createContext(request *http.Request, response *caddyhttp.ResponseRecorder) *ComposeContext {
@@ -120,11 +392,25 @@ func (w *WebComposer) createContext(request *http.Request, response *caddyhttp.R
 	composeContext.cache = w.createCache()
 	composeContext.httpRequest = request
 	composeContext.httpResponse = response
+	composeContext.context = request.Context()
+	composeContext.sources = make(map[string]*WebSource)
+	composeContext.sourcesLock = new(sync.Mutex)
+
+	if w.ServerTiming {
+		composeContext.timings = new(serverTimings)
+	}
+
+	if w.Budget > 0 {
+		composeContext.context, composeContext.cancel = context.WithTimeout(request.Context(), time.Duration(w.Budget))
+	}
+
 	return composeContext
 }
 
 func (w WebComposer) newHttpClient() *http.Client {
 	result := new(http.Client)
+	result.Transport = w.transport
+	result.CheckRedirect = w.UpstreamPolicy.checkRedirect
 	return result
 }
 
@@ -144,6 +430,7 @@ func (w *WebComposer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 var (
 	_ caddy.Provisioner           = (*WebComposer)(nil)
 	_ caddy.Validator             = (*WebComposer)(nil)
+	_ caddy.CleanerUpper          = (*WebComposer)(nil)
 	_ caddyhttp.MiddlewareHandler = (*WebComposer)(nil)
 	_ caddyfile.Unmarshaler       = (*WebComposer)(nil)
 )
@@ -0,0 +1,120 @@
+package module
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// newTestComposer provisions the handler with a cache of its own, allowing
+// the loopback fragment servers of the tests.
+func newTestComposer(t *testing.T, w *WebComposer) *WebComposer {
+	t.Helper()
+
+	if w.UpstreamPolicy == nil {
+		w.UpstreamPolicy = &UpstreamPolicy{AllowPrivateNetworks: true}
+	}
+
+	if w.CacheName == "" {
+		w.CacheName = strings.ReplaceAll(t.Name(), "/", "-")
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+
+	if err := w.Provision(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	w.logger = zap.NewNop()
+
+	t.Cleanup(func() {
+		_ = w.Cleanup()
+		cancel()
+	})
+
+	return w
+}
+
+// fragmentServer serves the components of the tests.
+func fragmentServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// pageHandler answers with the html page and the headers, like the handler
+// proxying the origin of the page.
+func pageHandler(header http.Header, page string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+		for key, values := range header {
+			rw.Header()[key] = values
+		}
+
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, err := rw.Write([]byte(page))
+		return err
+	})
+}
+
+func serve(t *testing.T, w *WebComposer, r *http.Request, next caddyhttp.Handler) *httptest.ResponseRecorder {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+
+	if err := w.ServeHTTP(recorder, r, next); err != nil {
+		t.Fatal(err)
+	}
+
+	return recorder
+}
+
+func placeholderDiv(url string, name string) string {
+	return `<div data-webc-url="` + url + `" data-webc-name="` + name + `"></div>`
+}
+
+// A page without components is sent as the origin sent it, while the
+// validators and ranges of a composed one no longer apply.
+func TestServeValidators(t *testing.T) {
+	fragments := fragmentServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(`<div data-webc-name="x">X</div>`))
+	})
+
+	tests := []struct {
+		name string
+		body string
+		kept bool
+	}{
+		{"passed through", `<p>static</p>`, true},
+		{"composed", placeholderDiv(fragments.URL, "x"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := newTestComposer(t, &WebComposer{})
+			header := http.Header{
+				"Etag":          {`"page"`},
+				"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"},
+				"Accept-Ranges": {"bytes"},
+			}
+
+			page := `<html><head></head><body>` + test.body + `</body></html>`
+			result := serve(t, w, httptest.NewRequest(GET, "/page", nil), pageHandler(header, page)).Result()
+
+			for name, values := range header {
+				if got := result.Header.Get(name); (got == values[0]) != test.kept {
+					t.Errorf("%s %q, kept expected %t", name, got, test.kept)
+				}
+			}
+		})
+	}
+}
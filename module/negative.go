@@ -0,0 +1,168 @@
+package module
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+// NegativeCache keeps the failed responses and the missing components for
+// a while, so a broken upstream or template is not requested by every page.
+type NegativeCache struct {
+	// Time a 4xx response is cached. Not cached when zero.
+	ClientError caddy.Duration `json:"client_error,omitempty"`
+
+	// Time a 5xx response is cached. Not cached when zero.
+	ServerError caddy.Duration `json:"server_error,omitempty"`
+
+	// Time a component missing in a source response is remembered.
+	// Not remembered when zero.
+	MissingComponent caddy.Duration `json:"missing_component,omitempty"`
+}
+
+type errComponentNotFound struct {
+	name string
+}
+
+func (e errComponentNotFound) Error() string {
+	return "Component " + e.name + " not found"
+}
+
+func (n *NegativeCache) statusTTL(statusCode int) time.Duration {
+	if n == nil {
+		return 0
+	}
+
+	switch {
+	case statusCode >= 400 && statusCode < 500:
+		return time.Duration(n.ClientError)
+	case statusCode >= 500:
+		return time.Duration(n.ServerError)
+	}
+
+	return 0
+}
+
+// negativeCache returns the negative cache policy of the source, the one of
+// its service when set.
+func (w *WebComposer) negativeCache(s *WebSource) *NegativeCache {
+	if s.service != nil && s.service.Cache != nil && s.service.Cache.Negative != nil {
+		return s.service.Cache.Negative
+	}
+	return w.NegativeCache
+}
+
+// negativeCachedUntil returns until when the failed response is cached, nil
+// if it must not.
+func (s *WebSource) negativeCachedUntil(negative *NegativeCache) *time.Time {
+	if s.service != nil && s.service.Cache != nil && s.service.Cache.Disabled {
+		return nil
+	}
+
+	ttl := negative.statusTTL(*s.responseStatusCode)
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	result := time.Now().Add(ttl)
+	return &result
+}
+
+// holdStale serves the stale copy of a failed source for the server error
+// time, so the upstream is not requested again by every page meanwhile.
+func (ctx *ComposeContext) holdStale(stale *WebSource, failed *WebSource) {
+	ctx.cache.set(stale, nil)
+
+	if failed.service != nil && failed.service.Cache != nil && failed.service.Cache.Disabled {
+		return
+	}
+
+	ttl := ctx.webComposer.negativeCache(failed).statusTTL(http.StatusInternalServerError)
+
+	if ttl <= 0 {
+		return
+	}
+
+	validUntil := time.Now().Add(ttl)
+	ctx.webComposer.cache.extend(*stale.id, &validUntil)
+}
+
+// getCachedComponent returns the component of the source, remembering for
+// a while the names not found in it.
+func (ctx *ComposeContext) getCachedComponent(s *WebSource, name *string) (*WebComponent, error) {
+	cache := ctx.webComposer.cache
+
+	if cache.isMissing(*s.id, *name) {
+		return nil, errComponentNotFound{name: *name}
+	}
+
+	component, err := s.getWebComponent(name)
+
+	if err != nil {
+		if _, missing := err.(errComponentNotFound); missing {
+			ttl := time.Duration(0)
+			negative := ctx.webComposer.negativeCache(s)
+
+			if negative != nil {
+				ttl = time.Duration(negative.MissingComponent)
+			}
+
+			if ttl > 0 {
+				cache.rememberMissing(*s.id, *name, time.Now().Add(ttl))
+			}
+		}
+	}
+
+	return component, err
+}
+
+func sourceStatusError(s *WebSource) error {
+	if *s.responseStatusCode != http.StatusOK {
+		return errors.Errorf("The remote response was %d", *s.responseStatusCode)
+	}
+	return nil
+}
+
+func missingKey(id string, name string) string {
+	return id + "\n" + name
+}
+
+func (c *Cache) isMissing(id string, name string) bool {
+	c.mutex.RLock()
+	until, found := c.missing[missingKey(id, name)]
+	c.mutex.RUnlock()
+
+	if !found {
+		return false
+	}
+
+	if time.Now().After(until) {
+		c.mutex.Lock()
+		delete(c.missing, missingKey(id, name))
+		c.mutex.Unlock()
+		return false
+	}
+
+	return true
+}
+
+func (c *Cache) rememberMissing(id string, name string, until time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.missing[missingKey(id, name)] = until
+}
+
+// forgetMissing drops the missing components of the source, its new
+// response may have them. The lock must be held.
+func (c *Cache) forgetMissing(id string) {
+	prefix := id + "\n"
+
+	for key := range c.missing {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			delete(c.missing, key)
+		}
+	}
+}
@@ -69,13 +69,13 @@ func parseString(input *string) (*html.Node, error) {
 	return html.Parse(reader)
 }
 
-func attachIfRequired(parent *html.Node, nodeName string, attrName string, nodes []*html.Node) {
+func attachIfRequired(parent *html.Node, selector cascadia.Selector, attrName string, nodes []*html.Node) {
 	if parent != nil {
 		for _, node := range nodes {
 			src := attr(node, attrName, nil)
 
 			if src != nil {
-				if !containsNode(parent, nodeName, attrName, src) {
+				if !containsNode(parent, selector, attrName, src) {
 					appendContent(parent, node)
 				}
 			} else {
@@ -85,8 +85,8 @@ func attachIfRequired(parent *html.Node, nodeName string, attrName string, nodes
 	}
 }
 
-func containsNode(parent *html.Node, nodeName string, attrName string, src *string) bool {
-	nodes := cascadia.MustCompile(nodeName).MatchAll(parent)
+func containsNode(parent *html.Node, selector cascadia.Selector, attrName string, src *string) bool {
+	nodes := selector.MatchAll(parent)
 	for _, node := range nodes {
 		nodeSrc := attr(node, attrName, nil)
 
@@ -0,0 +1,324 @@
+package module
+
+import (
+	"container/list"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PageCache struct {
+	// Maximum time a composed page is kept, shortened by its Cache-Control.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Request headers the cached pages vary on. Pages whose Vary names
+	// other headers are not cached, nor the ones with components varying
+	// or keyed on other headers or cookies.
+	VaryHeaders []string `json:"vary_headers,omitempty"`
+
+	// Maximum number of pages kept, 1000 when zero.
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+type pageCache struct {
+	config       *PageCache
+	mutex        sync.Mutex
+	entries      map[string]*list.Element
+	order        *list.List
+	dependencies map[string]map[string]struct{}
+	unsubscribe  func()
+}
+
+type pageEntry struct {
+	key        string
+	statusCode int
+	headers    http.Header
+	content    []byte
+	sources    []string
+	validUntil time.Time
+}
+
+func (p *PageCache) provision() {
+	if p.TTL <= 0 {
+		p.TTL = caddy.Duration(time.Minute)
+	}
+
+	if p.MaxEntries <= 0 {
+		p.MaxEntries = 1000
+	}
+}
+
+func newPageCache(config *PageCache, sources *Cache) *pageCache {
+	result := new(pageCache)
+	result.config = config
+	result.entries = make(map[string]*list.Element)
+	result.order = list.New()
+	result.dependencies = make(map[string]map[string]struct{})
+	result.unsubscribe = sources.subscribe(result.invalidateSource)
+	return result
+}
+
+// close stops following the changes of the component cache, which may
+// outlive the page cache when shared.
+func (p *pageCache) close() {
+	p.unsubscribe()
+}
+
+func (p *pageCache) key(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.Host)
+	key.WriteString(r.URL.RequestURI())
+
+	for _, name := range p.config.VaryHeaders {
+		key.WriteString("\n")
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+
+	return key.String()
+}
+
+// servable reports whether the request can be answered from the cache, the
+// HEAD requests get the headers of the GET entries.
+func (p *pageCache) servable(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// storable reports whether the response of the request can be kept. The
+// HEAD responses have no body, so only the GET ones are. A response to a
+// request with credentials is kept only if it says it can be shared, or if
+// the pages vary on those credentials.
+func (p *pageCache) storable(r *http.Request, control cacheControl) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	if control.has("public") || control.has("s-maxage") {
+		return true
+	}
+
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if r.Header.Get(name) != "" && !containsHeaderName(p.config.VaryHeaders, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serve writes the cached page of the request, reporting whether it was
+// found.
+func (p *pageCache) serve(rw http.ResponseWriter, r *http.Request) (bool, error) {
+	if !p.servable(r) {
+		return false, nil
+	}
+
+	entry := p.get(p.key(r))
+
+	if entry == nil {
+		return false, nil
+	}
+
+	for key, values := range entry.headers {
+		rw.Header()[key] = append([]string{}, values...)
+	}
+
+	etag := entry.headers.Get("Etag")
+
+	if etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(http.StatusNotModified)
+		return true, nil
+	}
+
+	rw.WriteHeader(entry.statusCode)
+
+	if r.Method == http.MethodHead {
+		return true, nil
+	}
+
+	_, err := rw.Write(entry.content)
+	return true, err
+}
+
+func (p *pageCache) get(key string) *pageEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	element := p.entries[key]
+
+	if element == nil {
+		return nil
+	}
+
+	entry := element.Value.(*pageEntry)
+
+	if time.Now().After(entry.validUntil) {
+		p.remove(element)
+		return nil
+	}
+
+	p.order.MoveToFront(element)
+	return entry
+}
+
+// store keeps the composed page if neither its headers nor the ones of its
+// components forbid a shared cache to do it. The Cache-Control of the page
+// is checked apart, as it keeps its own with keep_cache_control.
+func (p *pageCache) store(r *http.Request, statusCode int, header http.Header, content []byte, sources map[string]*WebSource) {
+	if statusCode != http.StatusOK && statusCode != 0 {
+		return
+	}
+
+	if len(header.Values("Set-Cookie")) > 0 {
+		return
+	}
+
+	control := parseCacheControl(header)
+
+	if !control.storable() || !p.storable(r, control) {
+		return
+	}
+
+	if !p.variesOn(header.Values("Vary")) {
+		return
+	}
+
+	for _, source := range sources {
+		if !p.shareable(source) {
+			return
+		}
+	}
+
+	ttl := time.Duration(p.config.TTL)
+	maxAge, found := control.seconds("s-maxage")
+
+	if !found {
+		maxAge, found = control.seconds("max-age")
+	}
+
+	if found && time.Duration(maxAge)*time.Second < ttl {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	entry := new(pageEntry)
+	entry.key = p.key(r)
+	entry.statusCode = http.StatusOK
+	entry.headers = header.Clone()
+	entry.headers.Del(ServerTimingHeader)
+	entry.content = append([]byte{}, content...)
+	entry.validUntil = time.Now().Add(ttl)
+
+	for id := range sources {
+		entry.sources = append(entry.sources, id)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	existing := p.entries[entry.key]
+
+	if existing != nil {
+		p.remove(existing)
+	}
+
+	p.entries[entry.key] = p.order.PushFront(entry)
+
+	for _, id := range entry.sources {
+		pages := p.dependencies[id]
+
+		if pages == nil {
+			pages = make(map[string]struct{})
+			p.dependencies[id] = pages
+		}
+
+		pages[entry.key] = struct{}{}
+	}
+
+	for p.order.Len() > p.config.MaxEntries {
+		p.remove(p.order.Back())
+	}
+}
+
+// variesOn reports whether the pages are kept apart for every header the
+// Vary values name.
+func (p *pageCache) variesOn(values []string) bool {
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+
+			if name != "" && !containsHeaderName(p.config.VaryHeaders, name) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// shareable reports whether the page composed with the source can be
+// served to other requests: the component can be stored by a shared cache
+// and the page key covers the headers and cookies its response depends on.
+// The query parameters are part of the page key already.
+func (p *pageCache) shareable(source *WebSource) bool {
+	if source.responseHeaders != nil {
+		if !parseCacheControl(*source.responseHeaders).storable() {
+			return false
+		}
+
+		if !p.variesOn(source.responseHeaders.Values("Vary")) {
+			return false
+		}
+	}
+
+	if source.service == nil || source.service.CacheKey == nil {
+		return true
+	}
+
+	for _, name := range source.service.CacheKey.Headers {
+		if !containsHeaderName(p.config.VaryHeaders, name) {
+			return false
+		}
+	}
+
+	return len(source.service.CacheKey.Cookies) == 0 || containsHeaderName(p.config.VaryHeaders, "Cookie")
+}
+
+// invalidateSource drops every page composed with the source.
+func (p *pageCache) invalidateSource(id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key := range p.dependencies[id] {
+		element := p.entries[key]
+
+		if element != nil {
+			p.remove(element)
+		}
+	}
+
+	delete(p.dependencies, id)
+}
+
+func (p *pageCache) remove(element *list.Element) {
+	entry := element.Value.(*pageEntry)
+	p.order.Remove(element)
+	delete(p.entries, entry.key)
+
+	for _, id := range entry.sources {
+		pages := p.dependencies[id]
+
+		if pages != nil {
+			delete(pages, entry.key)
+
+			if len(pages) == 0 {
+				delete(p.dependencies, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package module
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A page is dropped when a component it was composed with is stored again,
+// even if the component left the memory in between.
+func TestPageCacheInvalidatedAfterEviction(t *testing.T) {
+	sources := new(WebComposer).createCache()
+	sources.limits = &MemoryCache{MaxEntries: 1}
+	sources.limits.provision()
+
+	config := &PageCache{}
+	config.provision()
+	pages := newPageCache(config, sources)
+	defer pages.close()
+
+	method, component, other := GET, "https://example.org/a", "https://example.org/b"
+	source := newSource(&method, &component, nil)
+	validUntil := time.Now().Add(time.Minute)
+	sources.set(source, &validUntil)
+
+	request := httptest.NewRequest(http.MethodGet, "/page", nil)
+	header := http.Header{"Cache-Control": {"public, max-age=60"}}
+	pages.store(request, http.StatusOK, header, []byte("page"), map[string]*WebSource{*source.id: source})
+
+	if pages.get(pages.key(request)) == nil {
+		t.Fatal("not stored")
+	}
+
+	sources.set(newSource(&method, &other, nil), &validUntil)
+
+	if sources.entry(*source.id) != nil {
+		t.Fatal("component not evicted")
+	}
+
+	if pages.get(pages.key(request)) == nil {
+		t.Fatal("page dropped by another component")
+	}
+
+	sources.set(newSource(&method, &component, nil), &validUntil)
+
+	if pages.get(pages.key(request)) != nil {
+		t.Error("page kept after its component changed")
+	}
+}
+
+// The pages with personal components are not served to other users: the
+// components saying they cannot be shared, and the ones keyed on a cookie
+// the pages do not vary on.
+func TestPageCachePersonalComponents(t *testing.T) {
+	fragments := fragmentServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		session, _ := r.Cookie("session")
+
+		for key, values := range r.URL.Query() {
+			rw.Header()[key] = values
+		}
+
+		_, _ = rw.Write([]byte(`<div data-webc-name="x">` + session.Value + `</div>`))
+	})
+
+	tests := []struct {
+		name     string
+		header   string
+		cacheKey *CacheKey
+		vary     []string
+		shared   bool
+	}{
+		{name: "public", header: "Cache-Control=public", shared: true},
+		{name: "private", header: "Cache-Control=private"},
+		{name: "no store", header: "Cache-Control=no-store"},
+		{name: "vary", header: "Vary=Cookie"},
+		{name: "vary covered", header: "Vary=Cookie", vary: []string{"Cookie"}},
+		{name: "cookie key", cacheKey: &CacheKey{Cookies: []string{"session"}}},
+		{name: "cookie key covered", cacheKey: &CacheKey{Cookies: []string{"session"}}, vary: []string{"Cookie"}},
+		{name: "header key", cacheKey: &CacheKey{Headers: []string{"X-Tenant"}}, vary: []string{"Cookie"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := newTestComposer(t, &WebComposer{
+				KeepCacheControl: true,
+				PageCache:        &PageCache{VaryHeaders: test.vary},
+				Services: map[string]*Service{"fragments": {
+					URLs:           []string{fragments.URL},
+					ForwardHeaders: []string{"Cookie"},
+					CacheKey:       test.cacheKey,
+				}},
+			})
+
+			page := `<html><head></head><body>` + placeholderDiv("svc://fragments/x?"+test.header, "x") + `</body></html>`
+			header := http.Header{"Cache-Control": {"public, max-age=60"}}
+
+			for _, user := range []string{"alice", "bob"} {
+				request := httptest.NewRequest(http.MethodGet, "/page", nil)
+				request.Header.Set("Cookie", "session="+user)
+				body := serve(t, w, request, pageHandler(header, page)).Body.String()
+
+				if !test.shared && !strings.Contains(body, ">"+user+"<") {
+					t.Errorf("page of %s: %s", user, body)
+				}
+
+				if test.shared && !strings.Contains(body, ">alice<") {
+					t.Errorf("page not shared: %s", body)
+				}
+			}
+		})
+	}
+}
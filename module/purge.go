@@ -0,0 +1,125 @@
+package module
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const PurgeMethod = "PURGE"
+
+// Purge enables PURGE requests carrying Surrogate-Key or Cache-Tag
+// headers, which delete every cached component tagged with them.
+type Purge struct {
+	// Networks allowed to purge, in CIDR notation. Loopback when empty.
+	AllowedNetworks []string `json:"allowed_networks,omitempty"`
+
+	allowedNetworks []*net.IPNet
+}
+
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+func (p *Purge) provision() error {
+	if len(p.AllowedNetworks) == 0 {
+		p.AllowedNetworks = []string{"127.0.0.0/8", "::1/128"}
+	}
+
+	var err error
+	p.allowedNetworks, err = parseNetworks(p.AllowedNetworks)
+
+	return err
+}
+
+func (p *Purge) isAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tags returns the Surrogate-Key (space separated) and Cache-Tag (comma
+// separated) values of the response.
+func (s *WebSource) tags() []string {
+	if s.responseHeaders == nil {
+		return nil
+	}
+
+	return parseTags(*s.responseHeaders)
+}
+
+func parseTags(header http.Header) []string {
+	var result []string
+
+	for _, value := range header.Values("Surrogate-Key") {
+		for _, tag := range strings.Fields(value) {
+			if !containsString(result, tag) {
+				result = append(result, tag)
+			}
+		}
+	}
+
+	for _, value := range header.Values("Cache-Tag") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+
+			if tag != "" && !containsString(result, tag) {
+				result = append(result, tag)
+			}
+		}
+	}
+
+	return result
+}
+
+// PurgeTag deletes every cached component tagged with the tag and
+// returns how many were deleted.
+func (w *WebComposer) PurgeTag(tag string) int {
+	return w.cache.purgeTag(tag)
+}
+
+func (w *WebComposer) servePurge(rw http.ResponseWriter, r *http.Request) error {
+	if !w.Purge.isAllowed(r) {
+		return caddyhttp.Error(http.StatusForbidden, errors.Errorf("Purge not allowed from %s", r.RemoteAddr))
+	}
+
+	tags := parseTags(r.Header)
+
+	if len(tags) == 0 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("Purge without Surrogate-Key or Cache-Tag"))
+	}
+
+	result := purgeResult{}
+
+	for _, tag := range tags {
+		result.Purged += w.PurgeTag(tag)
+	}
+
+	w.logger.Info(
+		"cache purged",
+		zap.Strings("tags", tags),
+		zap.Int("purged", result.Purged),
+	)
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(result)
+}
@@ -0,0 +1,253 @@
+package module
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultIdempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+}
+
+type Retry struct {
+	// Attempts sent after the first one.
+	MaxRetries int `json:"max_retries,omitempty"`
+
+	// Methods that can be retried, GET, HEAD and OPTIONS when empty.
+	Methods []string `json:"methods,omitempty"`
+
+	// Response statuses retried besides connection errors, 502, 503 and
+	// 504 when empty.
+	RetryStatus []int `json:"retry_status,omitempty"`
+
+	InitialBackoff caddy.Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     caddy.Duration `json:"max_backoff,omitempty"`
+}
+
+type Hedging struct {
+	// Time to wait before sending the hedged request. When zero the p95
+	// latency of the service is used.
+	Delay caddy.Duration `json:"delay,omitempty"`
+
+	// Latency samples needed before the p95 is trusted.
+	MinSamples int `json:"min_samples,omitempty"`
+
+	// Methods that can be hedged, GET, HEAD and OPTIONS when empty.
+	Methods []string `json:"methods,omitempty"`
+}
+
+type latencyWindow struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (r *Retry) provision() {
+	if len(r.Methods) == 0 {
+		r.Methods = defaultIdempotentMethods
+	}
+
+	if len(r.RetryStatus) == 0 {
+		r.RetryStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+
+	if r.InitialBackoff <= 0 {
+		r.InitialBackoff = caddy.Duration(50 * time.Millisecond)
+	}
+
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = caddy.Duration(time.Second)
+	}
+}
+
+func (h *Hedging) provision() {
+	if len(h.Methods) == 0 {
+		h.Methods = defaultIdempotentMethods
+	}
+
+	if h.MinSamples <= 0 {
+		h.MinSamples = 20
+	}
+}
+
+func (r *Retry) mustRetry(result *fetchResult, err error) bool {
+	if err != nil {
+		return !errors.Is(err, errCircuitOpen) &&
+			!errors.Is(err, errBulkheadFull) &&
+			!errors.Is(err, errRateLimited) &&
+			!errors.Is(err, context.Canceled)
+	}
+
+	for _, status := range r.RetryStatus {
+		if status == result.statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the exponential backoff of the attempt with equal
+// jitter, so retries of concurrent pages spread over time.
+func (r *Retry) backoff(attempt int) time.Duration {
+	backoff := time.Duration(r.InitialBackoff) << attempt
+
+	if backoff <= 0 || backoff > time.Duration(r.MaxBackoff) {
+		backoff = time.Duration(r.MaxBackoff)
+	}
+
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, candidate := range methods {
+		if strings.EqualFold(candidate, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchWithRetries fetches the source retrying transient failures while
+// the page budget allows it.
+func (s *WebSource) fetchWithRetries(c ComposeContext) (*fetchResult, error) {
+	var retry *Retry
+
+	if s.service != nil && s.service.Retry != nil && containsMethod(s.service.Retry.Methods, *s.method) {
+		retry = s.service.Retry
+	}
+
+	for attempt := 0; ; attempt++ {
+		result, err := s.fetchHedged(c)
+
+		if retry == nil || attempt >= retry.MaxRetries || !retry.mustRetry(result, err) {
+			return result, err
+		}
+
+		backoff := retry.backoff(attempt)
+		deadline, hasDeadline := c.context.Deadline()
+
+		if hasDeadline && time.Now().Add(backoff).After(deadline) {
+			return result, err
+		}
+
+		composerMetrics.retries.WithLabelValues(s.service.name).Inc()
+
+		select {
+		case <-c.context.Done():
+			return result, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// fetchHedged fetches the source and, when hedging is enabled, sends a
+// second request if the first one is slower than the hedging delay. The
+// first successful response wins and the other request is cancelled.
+func (s *WebSource) fetchHedged(c ComposeContext) (*fetchResult, error) {
+	delay, hedge := s.hedgeDelay()
+
+	if !hedge {
+		return s.fetch(c, c.context)
+	}
+
+	requestContext, cancel := context.WithCancel(c.context)
+	defer cancel()
+
+	type outcome struct {
+		result *fetchResult
+		err    error
+	}
+
+	outcomes := make(chan outcome, 2)
+	launch := func() {
+		go func() {
+			result, err := s.fetch(c, requestContext)
+			outcomes <- outcome{result, err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	launch()
+	pending := 1
+	hedged := false
+
+	for {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				pending++
+				composerMetrics.hedgedRequests.WithLabelValues(s.service.name).Inc()
+				launch()
+			}
+		case last := <-outcomes:
+			pending--
+
+			if last.err == nil || pending == 0 {
+				return last.result, last.err
+			}
+		}
+	}
+}
+
+func (s *WebSource) hedgeDelay() (time.Duration, bool) {
+	if s.service == nil || s.service.Hedging == nil {
+		return 0, false
+	}
+
+	hedging := s.service.Hedging
+
+	if !containsMethod(hedging.Methods, *s.method) {
+		return 0, false
+	}
+
+	if hedging.Delay > 0 {
+		return time.Duration(hedging.Delay), true
+	}
+
+	return s.service.latencies.percentile(0.95, hedging.MinSamples)
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	result := new(latencyWindow)
+	result.samples = make([]time.Duration, 0, size)
+	return result
+}
+
+func (l *latencyWindow) add(duration time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.samples) < cap(l.samples) {
+		l.samples = append(l.samples, duration)
+	} else {
+		l.samples[l.next] = duration
+	}
+	l.next = (l.next + 1) % cap(l.samples)
+}
+
+func (l *latencyWindow) percentile(percentile float64, minSamples int) (time.Duration, bool) {
+	l.mutex.Lock()
+	samples := make([]time.Duration, len(l.samples))
+	copy(samples, l.samples)
+	l.mutex.Unlock()
+
+	if len(samples) == 0 || len(samples) < minSamples {
+		return 0, false
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[int(float64(len(samples)-1)*percentile)], true
+}
@@ -0,0 +1,233 @@
+package module
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var defaultAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+}
+
+// Ranges that are not covered by the net.IP helpers but must never be
+// reached from a component url, like the cloud metadata endpoints.
+var reservedNetworks = []string{
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+}
+
+// UpstreamPolicy restricts the urls the composer is allowed to fetch
+// components from. Services are always trusted unless AllowedServices is
+// set, plain urls are checked against the allowlists and can never reach
+// private networks unless explicitly allowed.
+type UpstreamPolicy struct {
+	// Host patterns plain urls can point to, like *.example.com. Any host
+	// is allowed when both AllowedHosts and AllowedURLs are empty.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+
+	// Regular expressions the whole plain url must match, they are
+	// anchored at both ends.
+	AllowedURLs []string `json:"allowed_urls,omitempty"`
+
+	// Services templates can reference, all when empty.
+	AllowedServices []string `json:"allowed_services,omitempty"`
+
+	// Component methods allowed, GET, HEAD and POST when empty.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+
+	// Networks plain urls can reach even if private, in CIDR notation.
+	AllowedNetworks []string `json:"allowed_networks,omitempty"`
+
+	// Let plain urls reach loopback, private and link-local addresses.
+	AllowPrivateNetworks bool `json:"allow_private_networks,omitempty"`
+
+	allowedUrls     []*regexp.Regexp
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+}
+
+func (p *UpstreamPolicy) provision() error {
+	if len(p.AllowedMethods) == 0 {
+		p.AllowedMethods = defaultAllowedMethods
+	}
+
+	p.allowedUrls = nil
+	for _, expression := range p.AllowedURLs {
+		compiled, err := regexp.Compile("^(?:" + expression + ")$")
+
+		if err != nil {
+			return errors.Wrapf(err, "Invalid allowed url %s", expression)
+		}
+
+		p.allowedUrls = append(p.allowedUrls, compiled)
+	}
+
+	var err error
+	p.allowedNetworks, err = parseNetworks(p.AllowedNetworks)
+
+	if err != nil {
+		return err
+	}
+
+	p.deniedNetworks, err = parseNetworks(reservedNetworks)
+
+	return err
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid network %s", cidr)
+		}
+
+		result = append(result, network)
+	}
+
+	return result, nil
+}
+
+// checkSource verifies the source can be fetched before any request is
+// sent. The addresses are checked again when dialing.
+func (p *UpstreamPolicy) checkSource(s *WebSource) error {
+	if !containsMethod(p.AllowedMethods, *s.method) {
+		return errors.Errorf("Method %s is not allowed", *s.method)
+	}
+
+	if s.service != nil {
+		if len(p.AllowedServices) > 0 && !containsString(p.AllowedServices, s.service.name) {
+			return errors.Errorf("Service %s is not allowed", s.service.name)
+		}
+		return nil
+	}
+
+	componentUrl, err := url.Parse(*s.url)
+
+	if err != nil {
+		return err
+	}
+
+	return p.checkUrl(componentUrl)
+}
+
+func (p *UpstreamPolicy) checkUrl(componentUrl *url.URL) error {
+	if componentUrl.Scheme != "http" && componentUrl.Scheme != "https" {
+		return errors.Errorf("Scheme %s is not allowed", componentUrl.Scheme)
+	}
+
+	if len(p.AllowedHosts) == 0 && len(p.allowedUrls) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(componentUrl.Hostname())
+
+	for _, pattern := range p.AllowedHosts {
+		matched, _ := path.Match(strings.ToLower(pattern), host)
+
+		if matched {
+			return nil
+		}
+	}
+
+	for _, expression := range p.allowedUrls {
+		if expression.MatchString(componentUrl.String()) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("Url %s is not allowed", componentUrl.String())
+}
+
+func (p *UpstreamPolicy) isAllowedAddress(ip net.IP) bool {
+	for _, network := range p.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if p.AllowPrivateNetworks {
+		return true
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, network := range p.deniedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// control runs after the host has been resolved, right before connecting,
+// so a DNS answer changing between the check and the request is caught.
+func (p *UpstreamPolicy) control(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil || !p.isAllowedAddress(ip) {
+		return errors.Errorf("Address %s is not allowed", host)
+	}
+
+	return nil
+}
+
+// newGuardedTransport returns the transport used for plain urls, which
+// refuses to connect to addresses outside of the policy.
+func (p *UpstreamPolicy) newGuardedTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   p.control,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	return transport
+}
+
+func (p *UpstreamPolicy) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("Stopped after 10 redirects")
+	}
+	return p.checkUrl(request.URL)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package module
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func provisionedPolicy(t *testing.T, policy *UpstreamPolicy) *UpstreamPolicy {
+	t.Helper()
+
+	err := policy.provision()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return policy
+}
+
+func TestIsAllowedAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  UpstreamPolicy
+		ip      string
+		allowed bool
+	}{
+		{"public ipv4", UpstreamPolicy{}, "93.184.216.34", true},
+		{"public ipv6", UpstreamPolicy{}, "2606:2800:220:1:248:1893:25c8:1946", true},
+		{"loopback", UpstreamPolicy{}, "127.0.0.1", false},
+		{"loopback ipv6", UpstreamPolicy{}, "::1", false},
+		{"private 10/8", UpstreamPolicy{}, "10.1.2.3", false},
+		{"private 172.16/12", UpstreamPolicy{}, "172.16.0.1", false},
+		{"private 192.168/16", UpstreamPolicy{}, "192.168.1.1", false},
+		{"unique local ipv6", UpstreamPolicy{}, "fd00::1", false},
+		{"unspecified", UpstreamPolicy{}, "0.0.0.0", false},
+		{"link local metadata", UpstreamPolicy{}, "169.254.169.254", false},
+		{"link local ipv6", UpstreamPolicy{}, "fe80::1", false},
+		{"multicast", UpstreamPolicy{}, "224.0.0.1", false},
+		{"this network", UpstreamPolicy{}, "0.1.2.3", false},
+		{"carrier grade nat", UpstreamPolicy{}, "100.64.0.1", false},
+		{"ietf protocol assignments", UpstreamPolicy{}, "192.0.0.170", false},
+		{"benchmarking", UpstreamPolicy{}, "198.18.0.1", false},
+		{"reserved", UpstreamPolicy{}, "240.0.0.1", false},
+		{"ipv4 mapped loopback", UpstreamPolicy{}, "::ffff:127.0.0.1", false},
+		{"private networks allowed", UpstreamPolicy{AllowPrivateNetworks: true}, "10.1.2.3", true},
+		{"allowed network", UpstreamPolicy{AllowedNetworks: []string{"10.1.0.0/16"}}, "10.1.2.3", true},
+		{"outside allowed network", UpstreamPolicy{AllowedNetworks: []string{"10.1.0.0/16"}}, "10.2.0.1", false},
+		{"allowed network over reserved", UpstreamPolicy{AllowedNetworks: []string{"100.64.0.0/10"}}, "100.64.0.1", true},
+		{"allowed network over link local", UpstreamPolicy{AllowedNetworks: []string{"169.254.169.254/32"}}, "169.254.169.254", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := provisionedPolicy(t, &test.policy)
+
+			if allowed := policy.isAllowedAddress(net.ParseIP(test.ip)); allowed != test.allowed {
+				t.Errorf("isAllowedAddress(%s) = %v, expected %v", test.ip, allowed, test.allowed)
+			}
+		})
+	}
+}
+
+func TestControl(t *testing.T) {
+	policy := provisionedPolicy(t, &UpstreamPolicy{AllowedNetworks: []string{"10.0.0.1/32"}})
+
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:80", true},
+		{"10.0.0.1:80", true},
+		{"10.0.0.2:80", false},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"localhost:80", false},
+		{"93.184.216.34", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			err := policy.control("tcp", test.address, nil)
+
+			if (err == nil) != test.allowed {
+				t.Errorf("control(%s) = %v, expected allowed %v", test.address, err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  UpstreamPolicy
+		url     string
+		allowed bool
+	}{
+		{"any host", UpstreamPolicy{}, "https://example.com/a", true},
+		{"file scheme", UpstreamPolicy{}, "file:///etc/passwd", false},
+		{"gopher scheme", UpstreamPolicy{}, "gopher://example.com/", false},
+		{"allowed host", UpstreamPolicy{AllowedHosts: []string{"*.example.com"}}, "https://cdn.example.com/a", true},
+		{"allowed host case", UpstreamPolicy{AllowedHosts: []string{"*.Example.com"}}, "https://CDN.example.COM/a", true},
+		{"other host", UpstreamPolicy{AllowedHosts: []string{"*.example.com"}}, "https://example.org/a", false},
+		{"suffix trick", UpstreamPolicy{AllowedHosts: []string{"*.example.com"}}, "https://cdn.example.com.evil.org/a", false},
+		{"userinfo trick", UpstreamPolicy{AllowedHosts: []string{"*.example.com"}}, "https://cdn.example.com@evil.org/a", false},
+		{"allowed url", UpstreamPolicy{AllowedURLs: []string{`https://example\.org/fragments/.*`}}, "https://example.org/fragments/a", true},
+		{"other url", UpstreamPolicy{AllowedURLs: []string{`https://example\.org/fragments/.*`}}, "https://example.org/admin", false},
+		{"url in the query", UpstreamPolicy{AllowedURLs: []string{`https://example\.org/fragments/.*`}}, "https://evil.example/?u=https://example.org/fragments/a", false},
+		{"unanchored expression", UpstreamPolicy{AllowedURLs: []string{`example\.org/fragments/`}}, "https://evil.example/example.org/fragments/", false},
+		{"url as userinfo", UpstreamPolicy{AllowedURLs: []string{`https://example\.org/.*`}}, "https://example.org@evil.example/", false},
+		{"anchors kept", UpstreamPolicy{AllowedURLs: []string{`^https://example\.org/a$`}}, "https://example.org/a", true},
+		{"alternatives anchored", UpstreamPolicy{AllowedURLs: []string{`https://a\.example/x|https://b\.example/y`}}, "https://evil.example/?https://b.example/y", false},
+		{"host or url", UpstreamPolicy{AllowedHosts: []string{"example.com"}, AllowedURLs: []string{`https://example\.org/.*`}}, "https://example.org/a", true},
+		{"scheme before allowlist", UpstreamPolicy{AllowedHosts: []string{"example.com"}}, "ftp://example.com/a", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := provisionedPolicy(t, &test.policy)
+			componentUrl, err := url.Parse(test.url)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = policy.checkUrl(componentUrl)
+
+			if (err == nil) != test.allowed {
+				t.Errorf("checkUrl(%s) = %v, expected allowed %v", test.url, err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	policy := provisionedPolicy(t, &UpstreamPolicy{
+		AllowedHosts:    []string{"example.com"},
+		AllowedServices: []string{"catalog"},
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		service string
+		allowed bool
+	}{
+		{"allowed url", GET, "https://example.com/a", "", true},
+		{"denied url", GET, "https://example.org/a", "", false},
+		{"denied method", http.MethodDelete, "https://example.com/a", "", false},
+		{"allowed service", GET, "svc://catalog/a", "catalog", true},
+		{"denied service", GET, "svc://admin/a", "admin", false},
+		{"method before service", http.MethodPut, "svc://catalog/a", "catalog", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newSource(&test.method, &test.url, nil)
+
+			if test.service != "" {
+				source.service = &Service{name: test.service}
+			}
+
+			err := policy.checkSource(source)
+
+			if (err == nil) != test.allowed {
+				t.Errorf("checkSource(%s %s) = %v, expected allowed %v", test.method, test.url, err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	policy := provisionedPolicy(t, &UpstreamPolicy{AllowedHosts: []string{"example.com"}})
+
+	tests := []struct {
+		name    string
+		url     string
+		via     int
+		allowed bool
+	}{
+		{"allowed host", "https://example.com/b", 1, true},
+		{"other host", "https://example.org/b", 1, false},
+		{"other scheme", "file:///etc/passwd", 1, false},
+		{"too many redirects", "https://example.com/b", 10, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(GET, test.url, nil)
+			via := make([]*http.Request, test.via)
+
+			err := policy.checkRedirect(request, via)
+
+			if (err == nil) != test.allowed {
+				t.Errorf("checkRedirect(%s) = %v, expected allowed %v", test.url, err, test.allowed)
+			}
+		})
+	}
+}
+
+// The redirects are checked again by the client, and the addresses when
+// dialing, so a public url cannot lead to a private one.
+func TestGuardedClient(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("secret"))
+	}))
+	defer target.Close()
+
+	redirect := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		location := strings.Replace(target.URL, "127.0.0.1", r.URL.Query().Get("host"), 1)
+		http.Redirect(rw, r, location, http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	tests := []struct {
+		name    string
+		policy  UpstreamPolicy
+		url     string
+		allowed bool
+	}{
+		{"private address", UpstreamPolicy{}, target.URL, false},
+		{"allowed network", UpstreamPolicy{AllowedNetworks: []string{"127.0.0.0/8"}}, target.URL, true},
+		{"redirect to other host", UpstreamPolicy{AllowedNetworks: []string{"127.0.0.0/8"}, AllowedHosts: []string{"127.0.0.1"}}, redirect.URL + "?host=localhost", false},
+		{"redirect to allowed host", UpstreamPolicy{AllowedNetworks: []string{"127.0.0.0/8"}, AllowedHosts: []string{"127.0.0.1", "localhost"}}, redirect.URL + "?host=localhost", true},
+		{"redirect to private address", UpstreamPolicy{AllowedNetworks: []string{"127.0.0.1/32"}}, redirect.URL + "?host=127.0.0.2", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := provisionedPolicy(t, &test.policy)
+			transport := policy.newGuardedTransport()
+			defer transport.CloseIdleConnections()
+
+			client := &http.Client{Transport: transport, CheckRedirect: policy.checkRedirect}
+			response, err := client.Get(test.url)
+
+			if err == nil {
+				_ = response.Body.Close()
+			}
+
+			if (err == nil) != test.allowed {
+				t.Errorf("get %s = %v, expected allowed %v", test.url, err, test.allowed)
+			}
+		})
+	}
+}
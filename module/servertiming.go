@@ -0,0 +1,96 @@
+package module
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ServerTimingHeader = "Server-Timing"
+
+// serverTimings collects the cost of the components of a page, nil when
+// the Server-Timing header is disabled.
+type serverTimings struct {
+	mutex   sync.Mutex
+	entries []serverTiming
+}
+
+type serverTiming struct {
+	name     string
+	lookup   string
+	duration time.Duration
+}
+
+func (t *serverTimings) add(name string, lookup string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.entries = append(t.entries, serverTiming{name: name, lookup: lookup, duration: duration})
+}
+
+// write sets the header, with the total time first and then the components
+// in the order they were requested.
+func (t *serverTimings) write(header http.Header, total time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	metrics := []string{fmt.Sprintf(`webc;desc="composition";dur=%s`, milliseconds(total))}
+
+	for i, entry := range t.entries {
+		metrics = append(metrics, fmt.Sprintf(
+			`webc-%d;desc=%s;dur=%s`,
+			i+1,
+			quotedString(entry.name+" "+entry.lookup),
+			milliseconds(entry.duration),
+		))
+	}
+
+	header.Set(ServerTimingHeader, strings.Join(metrics, ", "))
+}
+
+// elapsed returns the cost of the source: the load time when it was
+// fetched, the time since the lookup started otherwise.
+func (s *WebSource) elapsed(lookup string, started time.Time) time.Duration {
+	if lookup == "miss" && s.loadTime != nil {
+		return *s.loadTime
+	}
+	return time.Since(started)
+}
+
+// quotedString returns the value as an RFC 7230 quoted-string. The names
+// come from the templates, so the characters a header cannot carry are
+// replaced by ? and the control ones dropped.
+func quotedString(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == ' ' || r == '\t' || (r > ' ' && r < 0x7f):
+			b.WriteRune(r)
+		case r >= 0x80:
+			b.WriteByte('?')
+		}
+	}
+
+	b.WriteByte('"')
+	return b.String()
+}
+
+func milliseconds(duration time.Duration) string {
+	return strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,50 @@
+package module
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuotedString(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"header hit", `"header hit"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"tab\tkept", "\"tab\tkept\""},
+		{"café", `"caf?"`},
+		{"line\r\nbreak", `"linebreak"`},
+		{"nul\x00del\x7f", `"nuldel"`},
+		{"bad \xff byte", `"bad ? byte"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if got := quotedString(test.value); got != test.expected {
+				t.Errorf("quotedString(%q) = %s, expected %s", test.value, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestServerTimingsWrite(t *testing.T) {
+	timings := new(serverTimings)
+	timings.add("header", "hit", 1500*time.Microsecond)
+	timings.add(`"menü"`, "miss", 20*time.Millisecond)
+
+	header := make(http.Header)
+	timings.write(header, 25*time.Millisecond)
+
+	expected := `webc;desc="composition";dur=25.000, webc-1;desc="header hit";dur=1.500, webc-2;desc="\"men?\" miss";dur=20.000`
+
+	if got := header.Get(ServerTimingHeader); got != expected {
+		t.Errorf("Server-Timing %s, expected %s", got, expected)
+	}
+
+	var disabled *serverTimings
+	disabled.add("header", "hit", time.Millisecond)
+	disabled.write(header, time.Millisecond)
+}
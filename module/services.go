@@ -0,0 +1,248 @@
+package module
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ServiceScheme = "svc"
+
+// Service is a named fragment service. Templates reference it with
+// data-webc-url="svc://<name>/<path>" and the composer resolves the
+// path against the base URL configured here.
+type Service struct {
+	// Base URLs of the service. The path of the component url is
+	// appended to the path of the base URL.
+	URLs []string `json:"urls,omitempty"`
+
+	// Request headers forwarded from the page request to the service, a
+	// shorthand for header_forwarding with only an allow list.
+	ForwardHeaders []string `json:"forward_headers,omitempty"`
+
+	// Rule deciding which page request headers reach the service.
+	HeaderForwarding *HeaderForwarding `json:"header_forwarding,omitempty"`
+
+	// Maximum time to wait for the service response.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Cache policy applied to the responses of the service.
+	Cache *ServiceCache `json:"cache,omitempty"`
+
+	// Parts of the page request the responses of the service depend on.
+	CacheKey *CacheKey `json:"cache_key,omitempty"`
+
+	// Credentials sent to the service instead of the page ones.
+	Auth *ServiceAuth `json:"auth,omitempty"`
+
+	// How the upstream is picked when the service has several urls.
+	LoadBalancing *LoadBalancing `json:"load_balancing,omitempty"`
+
+	// Health checks used to take failing upstreams out of the selection.
+	HealthChecks *HealthChecks `json:"health_checks,omitempty"`
+
+	// Circuit breaker shared by all the upstreams of the service.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+
+	// Retries of transient failures, bounded by the page budget.
+	Retry *Retry `json:"retry,omitempty"`
+
+	// Second request sent when the first one is slower than usual.
+	Hedging *Hedging `json:"hedging,omitempty"`
+
+	// Maximum concurrent requests to the service, unlimited when zero.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// Requests allowed to the service over time.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// Time a request waits for a free slot or a rate limit token before
+	// the component falls back.
+	QueueTimeout caddy.Duration `json:"queue_timeout,omitempty"`
+
+	name       string
+	upstreams  []*upstream
+	counter    uint32
+	breaker    *circuitBreaker
+	latencies  *latencyWindow
+	bulkhead   *bulkhead
+	limiter    *tokenBucket
+	httpClient *http.Client
+}
+
+type ServiceCache struct {
+	// Never store the responses of the service in the global cache.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Time to keep the responses that do not set a max-age.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Negative cache policy of the service, the handler one when empty.
+	Negative *NegativeCache `json:"negative,omitempty"`
+}
+
+type ServiceAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+func (s *Service) provision(name string) error {
+	s.name = name
+
+	if len(s.URLs) == 0 {
+		return errors.Errorf("Service %s has no urls", name)
+	}
+
+	replacer := caddy.NewReplacer()
+	s.upstreams = nil
+
+	for _, rawUrl := range s.URLs {
+		baseUrl, err := url.Parse(replacer.ReplaceAll(rawUrl, ""))
+
+		if err != nil {
+			return errors.Wrapf(err, "Service %s has an invalid url %s", name, rawUrl)
+		}
+
+		if baseUrl.Scheme == "" || baseUrl.Host == "" {
+			return errors.Errorf("Service %s url %s must be absolute", name, rawUrl)
+		}
+
+		s.upstreams = append(s.upstreams, newUpstream(baseUrl))
+	}
+
+	if s.Auth != nil {
+		s.Auth.Username = replacer.ReplaceAll(s.Auth.Username, "")
+		s.Auth.Password = replacer.ReplaceAll(s.Auth.Password, "")
+		s.Auth.Token = replacer.ReplaceAll(s.Auth.Token, "")
+	}
+
+	if s.HeaderForwarding == nil && len(s.ForwardHeaders) > 0 {
+		s.HeaderForwarding = &HeaderForwarding{Allow: s.ForwardHeaders}
+	}
+
+	if s.HeaderForwarding != nil {
+		err := s.HeaderForwarding.provision()
+
+		if err != nil {
+			return errors.Wrapf(err, "Service %s", name)
+		}
+	}
+
+	if s.CircuitBreaker != nil {
+		err := s.CircuitBreaker.provision()
+
+		if err != nil {
+			return errors.Wrapf(err, "Service %s", name)
+		}
+
+		s.breaker = newCircuitBreaker(s.CircuitBreaker, s.name)
+	}
+
+	if s.Retry != nil {
+		s.Retry.provision()
+	}
+
+	if s.Hedging != nil {
+		s.Hedging.provision()
+	}
+
+	s.latencies = newLatencyWindow(100)
+	s.httpClient = new(http.Client)
+
+	if s.MaxInFlight > 0 {
+		s.bulkhead = newBulkhead(s.MaxInFlight)
+	}
+
+	if s.RateLimit != nil {
+		err := s.RateLimit.provision()
+
+		if err != nil {
+			return errors.Wrapf(err, "Service %s", name)
+		}
+
+		s.limiter = newTokenBucket(s.RateLimit)
+	}
+
+	return s.provisionLoadBalancing()
+}
+
+// findService returns the service referenced by a svc:// url, nil when
+// the url is a plain one.
+func (w *WebComposer) findService(rawUrl *string) (*Service, error) {
+	if !isServiceUrl(rawUrl) {
+		return nil, nil
+	}
+
+	componentUrl, err := url.Parse(*rawUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	service := w.Services[componentUrl.Host]
+
+	if service == nil {
+		return nil, errors.Errorf("Service %s not defined", componentUrl.Host)
+	}
+
+	return service, nil
+}
+
+func isServiceUrl(rawUrl *string) bool {
+	return rawUrl != nil && strings.HasPrefix(strings.ToLower(*rawUrl), ServiceScheme+"://")
+}
+
+// resolve translates a svc:// url into the url of one of the service
+// upstreams.
+func (s *Service) resolve(rawUrl string) (string, *upstream, error) {
+	componentUrl, err := url.Parse(rawUrl)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	selected, err := s.selectUpstream()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return s.resolveWith(selected.baseUrl, componentUrl), selected, nil
+}
+
+func (s *Service) resolveWith(baseUrl *url.URL, componentUrl *url.URL) string {
+	result := *baseUrl
+	result.Path = strings.TrimSuffix(baseUrl.Path, "/") + componentUrl.Path
+	result.RawPath = ""
+
+	if componentUrl.RawQuery != "" {
+		if result.RawQuery != "" {
+			result.RawQuery = result.RawQuery + "&" + componentUrl.RawQuery
+		} else {
+			result.RawQuery = componentUrl.RawQuery
+		}
+	}
+
+	return result.String()
+}
+
+func (s *Service) applyAuth(header http.Header) {
+	if s.Auth == nil {
+		return
+	}
+
+	if s.Auth.Token != "" {
+		header.Set("Authorization", "Bearer "+s.Auth.Token)
+	} else if s.Auth.Username != "" {
+		request := http.Request{Header: header}
+		request.SetBasicAuth(s.Auth.Username, s.Auth.Password)
+	}
+}
+
+func (s *Service) timeout() time.Duration {
+	return time.Duration(s.Timeout)
+}
@@ -1,20 +1,23 @@
 package module
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
-	"github.com/andybalholm/cascadia"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/html"
 	"io"
 	"net/http"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type WebSource struct {
 	id                 *string
+	baseId             *string
+	keyParts           []string
 	method             *string
 	url                *string
 	body               *string
@@ -23,6 +26,10 @@ type WebSource struct {
 	responseContent    *string
 	cachedUntil        *time.Time
 	loadTime           *time.Duration
+	service            *Service
+	parseOnce          sync.Once
+	parsed             *parsedSource
+	parseErr           error
 }
 
 type WebComponent struct {
@@ -45,9 +52,49 @@ func newSource(method *string, url *string, body *string) *WebSource {
 	return result
 }
 
+type fetchResult struct {
+	statusCode int
+	headers    http.Header
+	content    string
+}
+
 func (s *WebSource) load(c ComposeContext) error {
 	ti := time.Now()
 	c.logCompositionDebug("composition fetching remote", s.url, s.method)
+
+	var span trace.Span
+	c.context, span = tracer(c.context).Start(c.context, "web-composer load", trace.WithAttributes(sourceAttributes(s)...))
+
+	result, err := s.fetchWithRetries(c)
+
+	if err != nil {
+		endSpan(span, 0, err)
+		return err
+	}
+
+	endSpan(span, result.statusCode, nil)
+
+	s.responseStatusCode = &result.statusCode
+	s.responseHeaders = &result.headers
+	s.responseContent = &result.content
+	duration := time.Since(ti)
+	s.loadTime = &duration
+	s.cachedUntil = s.calculateCachedUntil()
+
+	if result.statusCode != http.StatusOK {
+		negativeUntil := s.negativeCachedUntil(c.webComposer.negativeCache(s))
+
+		if negativeUntil != nil {
+			s.cachedUntil = negativeUntil
+		}
+	}
+
+	return nil
+}
+
+// fetch sends a single request for the source to the remote.
+func (s *WebSource) fetch(c ComposeContext, requestContext context.Context) (*fetchResult, error) {
+	ti := time.Now()
 	requestBody := ""
 
 	if s.body != nil {
@@ -55,55 +102,174 @@ func (s *WebSource) load(c ComposeContext) error {
 	}
 	bodyReader := strings.NewReader(requestBody)
 
-	request, err := http.NewRequest(*s.method, *s.url, bodyReader)
+	targetUrl, selected, err := s.targetUrl()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c.handoverRequestHeader(request.Header)
+	if s.service != nil && s.service.timeout() > 0 {
+		var cancel context.CancelFunc
+		requestContext, cancel = context.WithTimeout(requestContext, s.service.timeout())
+		defer cancel()
+	}
 
-	response, err := c.httpClient.Do(request)
+	request, err := http.NewRequestWithContext(requestContext, *s.method, targetUrl, bodyReader)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	c.handoverRequestHeader(request, s.service)
+	injectTraceContext(requestContext, request)
+
+	if s.service != nil {
+		s.service.applyAuth(request.Header)
+	}
+
+	// admitted before asking the breaker, a request rejected by the
+	// bulkhead or the rate limit must not take a half-open probe
+	if s.service != nil {
+		release, err := s.service.admit(requestContext)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer release()
+	}
+
+	breaker := c.webComposer.circuitBreaker(s, request.URL.Host)
+
+	if breaker != nil {
+		err = breaker.allow()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if selected != nil {
+		selected.begin()
+		defer selected.end()
+	}
+
+	client := c.httpClient
+
+	if s.service != nil {
+		client = s.service.httpClient
+	}
+
+	inFlight := composerMetrics.fetchesInFlight.WithLabelValues(serviceLabel(s))
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		s.recordResult(selected, breaker, time.Since(ti), 0, err)
+		return nil, err
 	}
 
 	data, err := io.ReadAll(response.Body)
+	s.recordResult(selected, breaker, time.Since(ti), response.StatusCode, err)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = response.Body.Close()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	dataString := string(data)
+	result := new(fetchResult)
+	result.statusCode = response.StatusCode
+	result.headers = response.Header
+	result.content = string(data)
 
-	s.responseStatusCode = &response.StatusCode
-	s.responseHeaders = &response.Header
-	s.responseContent = &dataString
-	duration := ti.Sub(time.Now())
-	s.loadTime = &duration
-	s.cachedUntil = s.calculateCachedUntil()
+	return result, nil
+}
 
-	return nil
+func (s *WebSource) targetUrl() (string, *upstream, error) {
+	if s.service != nil {
+		return s.service.resolve(*s.url)
+	}
+	return *s.url, nil, nil
+}
+
+func (s *WebSource) recordResult(selected *upstream, breaker *circuitBreaker, duration time.Duration, statusCode int, err error) {
+	if errors.Is(err, context.Canceled) {
+		// a cancelled request says nothing about the remote, its probe is
+		// given back so the half-open circuit can still resolve
+		if breaker != nil {
+			breaker.release()
+		}
+		return
+	}
+
+	label := serviceLabel(s)
+	composerMetrics.fetchDuration.WithLabelValues(label).Observe(duration.Seconds())
+	composerMetrics.fetchResponses.WithLabelValues(label, statusClass(statusCode, err)).Inc()
+
+	if isTimeout(err) {
+		composerMetrics.fetchTimeouts.WithLabelValues(label).Inc()
+	}
+
+	if selected != nil {
+		s.service.recordResult(selected, statusCode, err)
+	}
+
+	if s.service != nil && err == nil && statusCode < 500 {
+		s.service.latencies.add(duration)
+	}
+
+	if breaker != nil {
+		breaker.record(duration, statusCode, err)
+	}
 }
 
 func (s *WebSource) calculateCachedUntil() *time.Time {
-	prefix := "max-age="
-	value := s.responseHeaders.Get("Cache-Control")
-	if strings.HasPrefix(value, prefix) {
-		number, err := strconv.Atoi(strings.ReplaceAll(value, prefix, ""))
-
-		if err == nil {
-			result := time.Now()
-			result = result.Add(time.Duration(number) * time.Second)
+	if varyAll(s.responseHeaders) {
+		return nil
+	}
+
+	if s.service != nil && s.service.Cache != nil {
+		if s.service.Cache.Disabled || !parseCacheControl(*s.responseHeaders).storable() {
+			return nil
+		}
+
+		cachedUntil := s.calculateMaxAge()
+
+		if cachedUntil == nil && s.service.Cache.TTL > 0 {
+			result := time.Now().Add(time.Duration(s.service.Cache.TTL))
 			return &result
 		}
+
+		return cachedUntil
+	}
+
+	return s.calculateMaxAge()
+}
+
+func (s *WebSource) calculateMaxAge() *time.Time {
+	control := parseCacheControl(*s.responseHeaders)
+
+	if !control.storable() {
+		return nil
+	}
+
+	number, found := control.seconds("s-maxage")
+
+	if !found {
+		number, found = control.seconds("max-age")
+	}
+
+	if found {
+		result := time.Now()
+		result = result.Add(time.Duration(number) * time.Second)
+		return &result
 	}
 	return nil
 }
@@ -117,7 +283,7 @@ func (s *WebSource) calculateId() *string {
 
 	if s.url != nil {
 		hasher.Write([]byte("-"))
-		hasher.Write([]byte(*s.url))
+		hasher.Write([]byte(normalizeUrl(*s.url)))
 	}
 
 	if s.body != nil {
@@ -125,67 +291,39 @@ func (s *WebSource) calculateId() *string {
 		hasher.Write([]byte(*s.body))
 	}
 
+	for _, part := range s.keyParts {
+		hasher.Write([]byte("\n"))
+		hasher.Write([]byte(part))
+	}
+
 	hash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 	return &hash
 }
 
 func (s *WebSource) getWebComponent(name *string) (*WebComponent, error) {
-	doc, err := parseString(s.responseContent)
+	parsed, err := s.parse()
 
 	if err != nil {
 		return nil, err
 	}
 
-	var componentNode *html.Node
-
-	divs := cascadia.MustCompile("div").MatchAll(doc)
-	for _, div := range divs {
-		url := attr(div, AttributeUrlKey, nil)
-		componentName := attr(div, AttributeNameKey, nil)
-
-		if url == nil && componentName != nil && *componentName == *name {
-			componentNode = div
-		}
-
-	}
+	componentNode := parsed.components[*name]
 
 	if componentNode == nil {
-		return nil, errors.Errorf("Component %s not found", *name)
+		return nil, errComponentNotFound{name: *name}
 	}
 
 	component := new(WebComponent)
 	component.name = name
 	component.source = s
 	component.headers = s.responseHeaders
-	component.content = componentNode
-
-	head := cascadia.MustCompile("head").MatchFirst(doc)
-
-	if head != nil {
-		component.stylesheets = cascadia.MustCompile("link").MatchAll(head)
-	}
-
-	body := cascadia.MustCompile("body").MatchFirst(doc)
-
-	if body != nil {
-		component.scripts = cascadia.MustCompile("script").MatchAll(body)
-	}
+	component.content = cloneNode(componentNode)
+	component.stylesheets = cloneNodes(parsed.stylesheets)
+	component.scripts = cloneNodes(parsed.scripts)
 
 	return component, nil
 }
 
-func (ctx *ComposeContext) handoverRequestHeader(header http.Header) {
-	for key, values := range ctx.httpRequest.Header {
-		if ctx.mustHandoverHeader(key) {
-			for _, value := range values {
-				if !containsHeaderValue(header, key, value) {
-					header.Add(key, value)
-				}
-			}
-		}
-	}
-}
-
 func containsHeaderValue(header http.Header, targetKey string, targetValue string) bool {
 	for key, values := range header {
 		for _, value := range values {
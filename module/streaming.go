@@ -0,0 +1,579 @@
+package module
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// StreamingInOrder writes the page as its components resolve, in document
+// order.
+const StreamingInOrder = "in_order"
+
+// StreamingOutOfOrder writes the whole page first, then each component as
+// it resolves, moved into its placeholder by an inline script. The clients
+// without javascript are redirected to the in order mode. The scripts carry
+// the nonce of the page Content-Security-Policy, and the page is written in
+// order when the policy blocks inline scripts without one.
+const StreamingOutOfOrder = "out_of_order"
+
+// StreamingQueryKey is the query parameter selecting the in order mode in
+// a page configured out of order.
+const StreamingQueryKey = "webc-streaming"
+
+const swapFunction = `function webcSwap(n){` +
+	`var s=document.querySelector('[data-webc-slot="'+n+'"]'),` +
+	`t=document.querySelector('template[data-webc-fragment="'+n+'"]');` +
+	`if(s&&t){s.replaceWith(t.content);t.remove()}}`
+
+// pageSegment is a part of a streamed page, either raw markup written as
+// is or a placeholder replaced by its component.
+type pageSegment struct {
+	raw         []byte
+	placeholder *placeholder
+	headEnd     bool
+	bodyEnd     bool
+}
+
+type placeholder struct {
+	method *string
+	url    *string
+	body   *string
+	name   *string
+	raw    []byte
+	index  int
+
+	// fragment is set before done is closed, nil if it failed.
+	fragment *fragmentResult
+	done     chan struct{}
+}
+
+// fragmentResult is a rendered component, with the assets it needs.
+type fragmentResult struct {
+	content     []byte
+	stylesheets []*html.Node
+	scripts     []*html.Node
+}
+
+// streamedPage is a page being written, remembering the assets already
+// sent so each is written once.
+type streamedPage struct {
+	writer  io.Writer
+	flusher http.Flusher
+	assets  map[string]struct{}
+	scripts []*html.Node
+
+	// nonce of the inline scripts, required by the page CSP.
+	nonce string
+}
+
+// canStream reports whether the recorded page can be streamed. The
+// validators need the whole content, so they disable streaming.
+func (w *WebComposer) canStream(rec caddyhttp.ResponseRecorder, r *http.Request) bool {
+	if w.Streaming == "" || w.ETag != "" || r.Method == http.MethodHead {
+		return false
+	}
+
+	if rec.Status() != http.StatusOK && rec.Status() != 0 {
+		return false
+	}
+
+	return !isDebugRequest(r) && containsMarker(rec.Buffer().Bytes())
+}
+
+// streamRequest writes the recorded page while its components are loaded.
+// The headers are sent before any component resolves, so theirs are not
+// merged into the page ones, and a page with placeholders is marked as not
+// storable since a component may be personalised.
+func (w *WebComposer) streamRequest(rw http.ResponseWriter, rec caddyhttp.ResponseRecorder, ctx *ComposeContext) error {
+	segments, assets, err := splitPage(rec.Buffer().Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	ctx.streaming = true
+
+	span := ctx.startSpan("web-composer stream")
+	defer span.End()
+	completed := make(chan *placeholder, len(segments))
+
+	for _, segment := range segments {
+		if segment.placeholder != nil {
+			go ctx.resolvePlaceholder(segment.placeholder, completed)
+		}
+	}
+
+	header := rw.Header()
+	w.ResponseHeaders.finish(header)
+
+	if !w.KeepCacheControl && hasPlaceholders(segments) {
+		restrictCacheControl(header)
+	}
+
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Del("Last-Modified")
+	header.Del("Etag")
+	rw.WriteHeader(http.StatusOK)
+
+	page := &streamedPage{writer: rw, assets: assets}
+	page.flusher, _ = rw.(http.Flusher)
+
+	if w.streamingMode(ctx.httpRequest) == StreamingOutOfOrder {
+		// the swaps are inline scripts, in order when the page CSP blocks them
+		nonce, allowed := inlineScriptNonce(header)
+
+		if allowed {
+			page.nonce = nonce
+			return page.writeOutOfOrder(segments, completed, inOrderUrl(ctx.httpRequest))
+		}
+	}
+
+	return page.writeInOrder(segments)
+}
+
+func hasPlaceholders(segments []pageSegment) bool {
+	for _, segment := range segments {
+		if segment.placeholder != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// streamingMode returns the mode of the request, the in order one when the
+// client asks for it.
+func (w *WebComposer) streamingMode(r *http.Request) string {
+	if w.Streaming == StreamingOutOfOrder && r.URL.Query().Get(StreamingQueryKey) == StreamingInOrder {
+		return StreamingInOrder
+	}
+	return w.Streaming
+}
+
+func inOrderUrl(r *http.Request) string {
+	result := *r.URL
+	query := result.Query()
+	query.Set(StreamingQueryKey, StreamingInOrder)
+	result.RawQuery = query.Encode()
+	return result.RequestURI()
+}
+
+func (p *streamedPage) writeInOrder(segments []pageSegment) error {
+	for _, segment := range segments {
+		var err error
+
+		switch {
+		case segment.placeholder != nil:
+			err = p.writeFragment(p.await(segment.placeholder), segment.placeholder.raw)
+		case segment.bodyEnd:
+			err = p.writeScripts()
+
+			if err == nil {
+				_, err = p.writer.Write(segment.raw)
+			}
+		default:
+			_, err = p.writer.Write(segment.raw)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	p.flush()
+	return nil
+}
+
+// writeOutOfOrder writes the page with the unresolved placeholders in
+// slots, then before the end of the body each component as it resolves.
+func (p *streamedPage) writeOutOfOrder(segments []pageSegment, completed <-chan *placeholder, fallbackUrl string) error {
+	pending := make(map[*placeholder]struct{})
+	drained := false
+
+	for _, segment := range segments {
+		var err error
+
+		switch {
+		case segment.placeholder != nil && segment.placeholder.resolved():
+			err = p.writeFragment(segment.placeholder.fragment, segment.placeholder.raw)
+		case segment.placeholder != nil:
+			pending[segment.placeholder] = struct{}{}
+			_, err = fmt.Fprintf(p.writer, `<div data-webc-slot="%d" style="display:contents">`, segment.placeholder.index)
+
+			if err == nil {
+				_, err = p.writer.Write(segment.placeholder.raw)
+			}
+
+			if err == nil {
+				_, err = io.WriteString(p.writer, "</div>")
+			}
+		case segment.headEnd:
+			_, err = fmt.Fprintf(
+				p.writer,
+				`<noscript><meta http-equiv="refresh" content="0; url=%s"></noscript>`,
+				html.EscapeString(fallbackUrl),
+			)
+
+			if err == nil {
+				_, err = p.writer.Write(segment.raw)
+			}
+		case segment.bodyEnd:
+			err = p.writeSwaps(pending, completed)
+			drained = true
+
+			if err == nil {
+				_, err = p.writer.Write(segment.raw)
+			}
+		default:
+			_, err = p.writer.Write(segment.raw)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !drained {
+		err := p.writeSwaps(pending, completed)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	p.flush()
+	return nil
+}
+
+// writeSwaps writes the pending components in the order they resolve, each
+// in a template moved into its slot.
+func (p *streamedPage) writeSwaps(pending map[*placeholder]struct{}, completed <-chan *placeholder) error {
+	err := p.writeScripts()
+
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	err = p.writeInlineScript(swapFunction)
+
+	if err != nil {
+		return err
+	}
+
+	for len(pending) > 0 {
+		p.flush()
+		resolved := <-completed
+
+		if _, found := pending[resolved]; !found {
+			continue
+		}
+
+		delete(pending, resolved)
+
+		if resolved.fragment == nil {
+			continue
+		}
+
+		index := strconv.Itoa(resolved.index)
+		_, err = io.WriteString(p.writer, `<template data-webc-fragment="`+index+`">`)
+
+		if err == nil {
+			err = p.writeFragment(resolved.fragment, nil)
+		}
+
+		if err == nil {
+			_, err = io.WriteString(p.writer, `</template>`)
+		}
+
+		if err == nil {
+			err = p.writeInlineScript(`webcSwap(` + index + `)`)
+		}
+
+		if err == nil {
+			err = p.writeScripts()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *streamedPage) writeInlineScript(code string) error {
+	var err error
+
+	if p.nonce == "" {
+		_, err = io.WriteString(p.writer, "<script>"+code+"</script>")
+	} else {
+		_, err = io.WriteString(p.writer, `<script nonce="`+html.EscapeString(p.nonce)+`">`+code+"</script>")
+	}
+
+	return err
+}
+
+// await returns the result of the placeholder, flushing what was written
+// before if it has not resolved yet.
+func (p *streamedPage) await(placeholder *placeholder) *fragmentResult {
+	if !placeholder.resolved() {
+		p.flush()
+		<-placeholder.done
+	}
+
+	return placeholder.fragment
+}
+
+func (p *placeholder) resolved() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeFragment writes the component, or the placeholder as it was if the
+// component could not be loaded.
+func (p *streamedPage) writeFragment(result *fragmentResult, fallback []byte) error {
+	if result == nil {
+		_, err := p.writer.Write(fallback)
+		return err
+	}
+
+	for _, stylesheet := range result.stylesheets {
+		if p.firstTime(stylesheet, "href") {
+			err := html.Render(p.writer, stylesheet)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, script := range result.scripts {
+		if p.firstTime(script, "src") {
+			p.scripts = append(p.scripts, script)
+		}
+	}
+
+	_, err := p.writer.Write(result.content)
+	return err
+}
+
+// writeScripts writes the scripts of the components written so far, done
+// at the end of the body like in a composed page.
+func (p *streamedPage) writeScripts() error {
+	for _, script := range p.scripts {
+		err := html.Render(p.writer, script)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	p.scripts = nil
+	return nil
+}
+
+func (p *streamedPage) firstTime(node *html.Node, attrName string) bool {
+	src := attr(node, attrName, nil)
+
+	if src == nil {
+		return true
+	}
+
+	key := node.Data + "\n" + *src
+
+	if _, found := p.assets[key]; found {
+		return false
+	}
+
+	p.assets[key] = struct{}{}
+	return true
+}
+
+func (p *streamedPage) flush() {
+	if p.flusher != nil {
+		p.flusher.Flush()
+	}
+}
+
+// resolvePlaceholder loads and renders the component of the placeholder,
+// then reports it as completed.
+func (ctx *ComposeContext) resolvePlaceholder(placeholder *placeholder, completed chan<- *placeholder) {
+	result, err := ctx.renderFragment(placeholder)
+
+	if err != nil {
+		ctx.logCompositionError("composition error", placeholder.method, placeholder.url, placeholder.name, err)
+		ctx.webComposer.countFallback("placeholder")
+		result = nil
+	}
+
+	placeholder.fragment = result
+	close(placeholder.done)
+	completed <- placeholder
+}
+
+func (ctx *ComposeContext) renderFragment(placeholder *placeholder) (*fragmentResult, error) {
+	ctx.logCompositionInfo("composition request", placeholder.method, placeholder.url, placeholder.name)
+
+	component, err := ctx.getWebComponent(placeholder.method, placeholder.url, placeholder.body, placeholder.name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	empty := ""
+	doc, err := parseString(&empty)
+
+	if err != nil {
+		return nil, err
+	}
+
+	holder := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	body := bodySelector.MatchFirst(doc)
+	appendContent(body, holder)
+
+	err = ctx.replaceComponent(doc, component, holder)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(fragmentResult)
+	var content bytes.Buffer
+	err = html.Render(&content, holder)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.content = content.Bytes()
+	result.stylesheets = linkSelector.MatchAll(headSelector.MatchFirst(doc))
+
+	for child := body.FirstChild; child != nil; child = child.NextSibling {
+		if child.DataAtom == atom.Script {
+			result.scripts = append(result.scripts, child)
+		}
+	}
+
+	return result, nil
+}
+
+// splitPage cuts the page into raw markup and placeholders, keeping the
+// original bytes of the markup. It also returns the stylesheets and
+// scripts the page already has.
+func splitPage(payload []byte) ([]pageSegment, map[string]struct{}, error) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(payload))
+	assets := make(map[string]struct{})
+	defaultMethod := GET
+
+	var segments []pageSegment
+	var raw []byte
+	var current *placeholder
+	depth := 0
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			if tokenizer.Err() == io.EOF {
+				break
+			}
+			return nil, nil, tokenizer.Err()
+		}
+
+		// copied before reading the token, which lowercases the tag names
+		tokenRaw := append([]byte{}, tokenizer.Raw()...)
+
+		if current != nil {
+			current.raw = append(current.raw, tokenRaw...)
+			token := tokenizer.Token()
+
+			if token.DataAtom == atom.Div && tokenType == html.StartTagToken {
+				depth++
+			} else if token.DataAtom == atom.Div && tokenType == html.EndTagToken {
+				depth--
+			}
+
+			if depth == 0 {
+				segments = append(segments, pageSegment{placeholder: current})
+				current = nil
+			}
+
+			continue
+		}
+
+		token := tokenizer.Token()
+
+		switch {
+		case token.DataAtom == atom.Div && tokenType == html.StartTagToken:
+			current = tokenPlaceholder(token, &defaultMethod)
+
+			if current != nil {
+				current.index = len(segments)
+				segments = append(segments, pageSegment{raw: raw})
+				raw = nil
+				current.raw = tokenRaw
+				depth = 1
+				continue
+			}
+		case token.DataAtom == atom.Head && tokenType == html.EndTagToken:
+			segments = append(segments, pageSegment{raw: raw})
+			segments = append(segments, pageSegment{raw: tokenRaw, headEnd: true})
+			raw = nil
+			continue
+		case token.DataAtom == atom.Body && tokenType == html.EndTagToken:
+			segments = append(segments, pageSegment{raw: raw})
+			segments = append(segments, pageSegment{raw: tokenRaw, bodyEnd: true})
+			raw = nil
+			continue
+		case token.DataAtom == atom.Link && tokenType != html.EndTagToken:
+			rememberAsset(assets, token, "href")
+		case token.DataAtom == atom.Script && tokenType == html.StartTagToken:
+			rememberAsset(assets, token, "src")
+		}
+
+		raw = append(raw, tokenRaw...)
+	}
+
+	if current != nil {
+		// unclosed placeholder, written as it was
+		raw = append(raw, current.raw...)
+	}
+
+	segments = append(segments, pageSegment{raw: raw})
+	return segments, assets, nil
+}
+
+func tokenPlaceholder(token html.Token, defaultMethod *string) *placeholder {
+	node := &html.Node{Type: html.ElementNode, Data: token.Data, Attr: token.Attr}
+	target := placeholderTarget(node, defaultMethod)
+
+	if target == nil {
+		return nil
+	}
+
+	return &placeholder{
+		method: target.method,
+		url:    target.url,
+		body:   target.body,
+		name:   attr(node, AttributeNameKey, nil),
+		done:   make(chan struct{}),
+	}
+}
+
+func rememberAsset(assets map[string]struct{}, token html.Token, attrName string) {
+	for _, attribute := range token.Attr {
+		if attribute.Key == attrName {
+			assets[token.Data+"\n"+attribute.Val] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package module
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamingFragments serves the components of the streaming tests, /slow
+// after a delay and /fail with an error.
+func streamingFragments(t *testing.T) *httptest.Server {
+	return fragmentServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+			_, _ = rw.Write([]byte(`<div data-webc-name="slow">Slow</div>`))
+		case "/fast":
+			_, _ = rw.Write([]byte(`<div data-webc-name="fast">Fast</div>`))
+		case "/fail":
+			rw.WriteHeader(http.StatusInternalServerError)
+		case "/assets":
+			_, _ = rw.Write([]byte(`<html><head><link rel="stylesheet" href="/c.css"><link rel="stylesheet" href="/page.css"></head>` +
+				`<body><div data-webc-name="x">X</div><div data-webc-name="y">Y</div><script src="/c.js"></script></body></html>`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func TestStreamInOrder(t *testing.T) {
+	fragments := streamingFragments(t)
+	w := newTestComposer(t, &WebComposer{Streaming: StreamingInOrder})
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "document order",
+			body:     `<p>1</p>` + placeholderDiv(fragments.URL+"/slow", "slow") + `<p>2</p>` + placeholderDiv(fragments.URL+"/fast", "fast"),
+			expected: `<p>1</p><div data-webc-name="slow">Slow</div><p>2</p><div data-webc-name="fast">Fast</div>`,
+		},
+		{
+			name:     "fallback on fragment error",
+			body:     `<p>1</p>` + placeholderDiv(fragments.URL+"/fail", "broken") + `<p>2</p>`,
+			expected: `<p>1</p>` + placeholderDiv(fragments.URL+"/fail", "broken") + `<p>2</p>`,
+		},
+		{
+			name:     "fallback on missing component",
+			body:     placeholderDiv(fragments.URL+"/fast", "other") + placeholderDiv(fragments.URL+"/fast", "fast"),
+			expected: placeholderDiv(fragments.URL+"/fast", "other") + `<div data-webc-name="fast">Fast</div>`,
+		},
+		{
+			name: "assets written once",
+			body: placeholderDiv(fragments.URL+"/assets", "x") + placeholderDiv(fragments.URL+"/assets", "y"),
+			expected: `<link rel="stylesheet" href="/c.css"/><div data-webc-name="x">X</div><div data-webc-name="y">Y</div>` +
+				`<script src="/c.js"></script>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := `<html><head><link rel="stylesheet" href="/page.css"></head><body>` + test.body + `</body></html>`
+			recorder := serve(t, w, httptest.NewRequest(GET, "/page", nil), pageHandler(nil, page))
+			expected := `<html><head><link rel="stylesheet" href="/page.css"></head><body>` + test.expected + `</body></html>`
+
+			if recorder.Body.String() != expected {
+				t.Errorf("body\n%s\nexpected\n%s", recorder.Body.String(), expected)
+			}
+		})
+	}
+}
+
+// The page headers are sent before the components resolve, so the page is
+// not storable and has no validators of the unresolved content.
+func TestStreamHeaders(t *testing.T) {
+	fragments := streamingFragments(t)
+
+	tests := []struct {
+		name         string
+		keep         bool
+		body         string
+		cacheControl string
+	}{
+		{"placeholders", false, placeholderDiv(fragments.URL+"/fast", "fast"), "no-store, private"},
+		{"keep cache control", true, placeholderDiv(fragments.URL+"/fast", "fast"), "public, max-age=60"},
+		{"no placeholders", false, `<div data-webc-name="local">Local</div>`, "public, max-age=60"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := newTestComposer(t, &WebComposer{Streaming: StreamingInOrder, KeepCacheControl: test.keep})
+			header := http.Header{
+				"Cache-Control":  {"public, max-age=60"},
+				"Etag":           {`"page"`},
+				"Last-Modified":  {"Mon, 02 Jan 2006 15:04:05 GMT"},
+				"Content-Length": {"1000"},
+				"Accept-Ranges":  {"bytes"},
+				"Expires":        {"Mon, 02 Jan 2006 15:05:05 GMT"},
+			}
+
+			page := `<html><head></head><body>` + test.body + `</body></html>`
+			recorder := serve(t, w, httptest.NewRequest(GET, "/page", nil), pageHandler(header, page))
+			result := recorder.Result()
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status %d", recorder.Code)
+			}
+
+			if got := result.Header.Get("Cache-Control"); got != test.cacheControl {
+				t.Errorf("Cache-Control %q, expected %q", got, test.cacheControl)
+			}
+
+			for _, name := range []string{"Etag", "Last-Modified", "Content-Length", "Accept-Ranges"} {
+				if got := result.Header.Get(name); got != "" {
+					t.Errorf("%s %q kept", name, got)
+				}
+			}
+
+			if !recorder.Flushed {
+				t.Error("page not flushed")
+			}
+		})
+	}
+}
+
+// The markup before a placeholder reaches the client while the component
+// is loaded.
+func TestStreamFlushesBeforePlaceholder(t *testing.T) {
+	release := make(chan struct{})
+
+	fragments := fragmentServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = rw.Write([]byte(`<div data-webc-name="late">Late</div>`))
+	})
+
+	w := newTestComposer(t, &WebComposer{Streaming: StreamingInOrder})
+	page := `<html><head><title>Page</title></head><body><h1>Title</h1>` + placeholderDiv(fragments.URL, "late") + `</body></html>`
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_ = w.ServeHTTP(rw, r, pageHandler(nil, page))
+	}))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	reader := bufio.NewReader(response.Body)
+	head, err := reader.ReadString('>')
+
+	for err == nil && !strings.HasSuffix(head, "<h1>Title</h1>") {
+		var next string
+		next, err = reader.ReadString('>')
+		head += next
+	}
+
+	close(release)
+
+	if err != nil {
+		t.Fatalf("page start not received: %v", err)
+	}
+
+	rest, _ := reader.ReadString(0)
+
+	if rest != `<div data-webc-name="late">Late</div></body></html>` {
+		t.Errorf("page end %q", rest)
+	}
+}
+
+var (
+	swapTemplate   = regexp.MustCompile(`<template data-webc-fragment="(\d+)">(.*?)</template><script[^>]*>webcSwap\(\d+\)</script>`)
+	swapDefinition = regexp.MustCompile(`<script[^>]*>function webcSwap\(n\)\{.*?</script>`)
+	noscript       = regexp.MustCompile(`<noscript>.*?</noscript>`)
+	emptySlot      = regexp.MustCompile(`<div data-webc-slot="\d+" style="display:contents">(<div[^>]*></div>)</div>`)
+)
+
+// applySwaps does what the swap scripts do in the browser, moving each
+// template into its slot, and returns the page as it is displayed. The
+// slots left, displayed as their content, are removed too.
+func applySwaps(t *testing.T, body string) string {
+	t.Helper()
+
+	for _, match := range swapTemplate.FindAllStringSubmatch(body, -1) {
+		slot := regexp.MustCompile(`<div data-webc-slot="` + match[1] + `" style="display:contents"><div[^>]*></div></div>`)
+
+		if !slot.MatchString(body) {
+			t.Fatalf("no slot %s for the template in %s", match[1], body)
+		}
+
+		body = slot.ReplaceAllLiteralString(body, match[2])
+	}
+
+	body = swapTemplate.ReplaceAllString(body, "")
+	body = swapDefinition.ReplaceAllString(body, "")
+	body = emptySlot.ReplaceAllString(body, "$1")
+	return noscript.ReplaceAllString(body, "")
+}
+
+func TestStreamOutOfOrder(t *testing.T) {
+	fragments := streamingFragments(t)
+	w := newTestComposer(t, &WebComposer{Streaming: StreamingOutOfOrder})
+	failed := placeholderDiv(fragments.URL+"/fail", "broken")
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "slow fragment swapped in place",
+			body:     `<p>1</p>` + placeholderDiv(fragments.URL+"/slow", "slow") + `<p>2</p>` + placeholderDiv(fragments.URL+"/fast", "fast") + `<p>3</p>`,
+			expected: `<p>1</p><div data-webc-name="slow">Slow</div><p>2</p><div data-webc-name="fast">Fast</div><p>3</p>`,
+		},
+		{
+			name:     "failed fragment left in its slot",
+			body:     placeholderDiv(fragments.URL+"/slow", "slow") + failed + placeholderDiv(fragments.URL+"/fast", "fast"),
+			expected: `<div data-webc-name="slow">Slow</div>` + failed + `<div data-webc-name="fast">Fast</div>`,
+		},
+		{
+			name: "assets before the swaps",
+			body: placeholderDiv(fragments.URL+"/slow", "slow") + placeholderDiv(fragments.URL+"/assets", "x"),
+			expected: `<div data-webc-name="slow">Slow</div><link rel="stylesheet" href="/c.css"/><link rel="stylesheet" href="/page.css"/>` +
+				`<div data-webc-name="x">X</div><script src="/c.js"></script>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := `<html><head></head><body>` + test.body + `</body></html>`
+			recorder := serve(t, w, httptest.NewRequest(GET, "/page", nil), pageHandler(nil, page))
+			body := recorder.Body.String()
+
+			if !strings.HasSuffix(body, "</body></html>") {
+				t.Fatalf("page not finished: %s", body)
+			}
+
+			if !strings.Contains(body, `<noscript><meta http-equiv="refresh" content="0; url=/page?webc-streaming=in_order"></noscript></head>`) {
+				t.Errorf("no in order fallback: %s", body)
+			}
+
+			expected := `<html><head></head><body>` + test.expected + `</body></html>`
+
+			if displayed := applySwaps(t, body); displayed != expected {
+				t.Errorf("displayed\n%s\nexpected\n%s\nsent\n%s", displayed, expected, body)
+			}
+		})
+	}
+}
+
+// The slow fragment is sent after the rest of the page, in a template.
+func TestStreamOutOfOrderSlowFragmentLast(t *testing.T) {
+	fragments := streamingFragments(t)
+	w := newTestComposer(t, &WebComposer{Streaming: StreamingOutOfOrder})
+	page := `<html><head></head><body>` + placeholderDiv(fragments.URL+"/slow", "slow") + `<p>end</p></body></html>`
+
+	body := serve(t, w, httptest.NewRequest(GET, "/page", nil), pageHandler(nil, page)).Body.String()
+	slot := strings.Index(body, `<div data-webc-slot="`)
+	end := strings.Index(body, `<p>end</p>`)
+	template := strings.Index(body, `"><div data-webc-name="slow">Slow</div></template>`)
+
+	if slot < 0 || end < slot || template < end {
+		t.Errorf("slot at %d, end of page at %d, template at %d: %s", slot, end, template, body)
+	}
+}
+
+func TestStreamOutOfOrderInOrderFallback(t *testing.T) {
+	fragments := streamingFragments(t)
+	w := newTestComposer(t, &WebComposer{Streaming: StreamingOutOfOrder})
+	page := `<html><head></head><body>` + placeholderDiv(fragments.URL+"/slow", "slow") + `</body></html>`
+
+	request := httptest.NewRequest(GET, "/page?webc-streaming=in_order", nil)
+	body := serve(t, w, request, pageHandler(nil, page)).Body.String()
+	expected := `<html><head></head><body><div data-webc-name="slow">Slow</div></body></html>`
+
+	if body != expected {
+		t.Errorf("body\n%s\nexpected\n%s", body, expected)
+	}
+}
@@ -0,0 +1,79 @@
+package module
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const tracerName = "github.com/acsgh/caddy-composer/module"
+
+// tracePropagator is the one of the Caddy tracing handler, the global one
+// is a no-op unless the process sets it.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracer returns the tracer of the provider of the span in the context.
+// Caddy does not set the global provider, so the spans are recorded only
+// when the tracing handler started the one of the page request.
+func tracer(ctx context.Context) trace.Tracer {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+}
+
+// startSpan starts a span covering the composition, used as parent by the
+// spans of the components.
+func (ctx *ComposeContext) startSpan(name string) trace.Span {
+	var span trace.Span
+	ctx.context, span = tracer(ctx.context).Start(
+		ctx.context,
+		name,
+		trace.WithAttributes(
+			attribute.String("http.method", ctx.httpRequest.Method),
+			attribute.String("http.target", ctx.httpRequest.URL.RequestURI()),
+			attribute.String("web_composer.route", ctx.webComposer.Name),
+		),
+	)
+	return span
+}
+
+func sourceAttributes(s *WebSource) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("web_composer.source.id", stringOrEmpty(s.id)),
+		attribute.String("web_composer.source.method", stringOrEmpty(s.method)),
+		attribute.String("web_composer.source.url", stringOrEmpty(s.url)),
+		attribute.String("web_composer.service", serviceLabel(s)),
+	}
+}
+
+func (ctx *ComposeContext) startCacheLookup(s *WebSource) trace.Span {
+	_, span := tracer(ctx.context).Start(ctx.context, "web-composer cache lookup", trace.WithAttributes(sourceAttributes(s)...))
+	return span
+}
+
+func endCacheLookup(span trace.Span, result string) {
+	span.SetAttributes(attribute.String("web_composer.cache.result", result))
+	span.End()
+}
+
+func endSpan(span trace.Span, statusCode int, err error) {
+	if statusCode != 0 {
+		span.SetAttributes(attribute.Int("http.status_code", statusCode))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+
+	span.End()
+}
+
+// injectTraceContext adds the traceparent of the context to the fragment
+// request.
+func injectTraceContext(requestContext context.Context, request *http.Request) {
+	tracePropagator.Inject(requestContext, propagation.HeaderCarrier(request.Header))
+}
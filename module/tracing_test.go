@@ -0,0 +1,110 @@
+package module
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// The spans are recorded by the provider of the page request span, like the
+// one of the Caddy tracing handler, and the fragment requests carry them.
+func TestTracingSpans(t *testing.T) {
+	var traceparent string
+
+	fragment := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		_, _ = rw.Write([]byte(`<div data-webc-name="header">Header</div>`))
+	}))
+	defer fragment.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	w := &WebComposer{
+		CacheName:      "tracing-test",
+		UpstreamPolicy: &UpstreamPolicy{AllowPrivateNetworks: true},
+	}
+
+	if err := w.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Cleanup() }()
+
+	w.logger = zap.NewNop()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+
+	requestContext, page := provider.Tracer("test").Start(context.Background(), "page")
+	request := httptest.NewRequest(GET, "/page", nil).WithContext(requestContext)
+
+	next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+		rw.Header().Set("Content-Type", "text/html")
+		_, err := rw.Write([]byte(`<html><body><div data-webc-url="` + fragment.URL + `" data-webc-name="header"></div></body></html>`))
+		return err
+	})
+
+	recorder := httptest.NewRecorder()
+
+	if err := w.ServeHTTP(recorder, request, next); err != nil {
+		t.Fatal(err)
+	}
+
+	page.End()
+
+	if !strings.Contains(recorder.Body.String(), "Header") {
+		t.Fatalf("component not composed: %s", recorder.Body.String())
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	root := page.SpanContext()
+	compose := spans["web-composer compose"]
+	lookup := spans["web-composer cache lookup"]
+	load := spans["web-composer load"]
+
+	tests := []struct {
+		name   string
+		span   tracetest.SpanStub
+		parent trace.SpanContext
+	}{
+		{"compose", compose, root},
+		{"cache lookup", lookup, compose.SpanContext},
+		{"load", load, compose.SpanContext},
+	}
+
+	for _, test := range tests {
+		if !test.span.SpanContext.IsValid() {
+			t.Errorf("%s span not recorded", test.name)
+			continue
+		}
+
+		if test.span.SpanContext.TraceID() != root.TraceID() {
+			t.Errorf("%s span in trace %s, expected %s", test.name, test.span.SpanContext.TraceID(), root.TraceID())
+		}
+
+		if test.span.Parent.SpanID() != test.parent.SpanID() {
+			t.Errorf("%s span child of %s, expected %s", test.name, test.span.Parent.SpanID(), test.parent.SpanID())
+		}
+	}
+
+	expected := "00-" + root.TraceID().String() + "-" + load.SpanContext.SpanID().String() + "-01"
+
+	if traceparent != expected {
+		t.Errorf("traceparent %q, expected %q", traceparent, expected)
+	}
+}
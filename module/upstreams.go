@@ -0,0 +1,280 @@
+package module
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoundRobinPolicy       = "round_robin"
+	LeastConnectionsPolicy = "least_conn"
+	RandomPolicy           = "random"
+)
+
+type LoadBalancing struct {
+	// Policy used to pick the upstream of each request: round_robin
+	// (default), least_conn or random.
+	SelectionPolicy string `json:"selection_policy,omitempty"`
+}
+
+type HealthChecks struct {
+	Passive *PassiveHealthChecks `json:"passive,omitempty"`
+	Active  *ActiveHealthChecks  `json:"active,omitempty"`
+}
+
+type PassiveHealthChecks struct {
+	// Consecutive failures after which the upstream is marked unhealthy.
+	MaxFails int `json:"max_fails,omitempty"`
+
+	// Time the upstream is kept out of the selection once unhealthy.
+	FailDuration caddy.Duration `json:"fail_duration,omitempty"`
+
+	// Response status codes counted as failures, 5xx when empty.
+	UnhealthyStatus []int `json:"unhealthy_status,omitempty"`
+}
+
+type ActiveHealthChecks struct {
+	// Path requested on every upstream, relative to its base url.
+	Path string `json:"path,omitempty"`
+
+	Interval caddy.Duration `json:"interval,omitempty"`
+	Timeout  caddy.Duration `json:"timeout,omitempty"`
+
+	// Expected response status, any 2xx when zero.
+	ExpectStatus int `json:"expect_status,omitempty"`
+}
+
+type upstream struct {
+	baseUrl        *url.URL
+	inFlight       int64
+	fails          int64
+	unhealthyUntil int64
+	activeHealthy  int32
+}
+
+func newUpstream(baseUrl *url.URL) *upstream {
+	result := new(upstream)
+	result.baseUrl = baseUrl
+	result.activeHealthy = 1
+	return result
+}
+
+func (u *upstream) healthy() bool {
+	if atomic.LoadInt32(&u.activeHealthy) == 0 {
+		return false
+	}
+	return atomic.LoadInt64(&u.unhealthyUntil) < time.Now().UnixNano()
+}
+
+func (u *upstream) begin() {
+	atomic.AddInt64(&u.inFlight, 1)
+}
+
+func (u *upstream) end() {
+	atomic.AddInt64(&u.inFlight, -1)
+}
+
+func (s *Service) provisionLoadBalancing() error {
+	if s.LoadBalancing == nil {
+		s.LoadBalancing = new(LoadBalancing)
+	}
+
+	switch s.LoadBalancing.SelectionPolicy {
+	case "":
+		s.LoadBalancing.SelectionPolicy = RoundRobinPolicy
+	case RoundRobinPolicy, LeastConnectionsPolicy, RandomPolicy:
+	default:
+		return errors.Errorf("Service %s has an unknown selection policy %s", s.name, s.LoadBalancing.SelectionPolicy)
+	}
+
+	if s.HealthChecks != nil && s.HealthChecks.Passive != nil {
+		passive := s.HealthChecks.Passive
+
+		if passive.MaxFails <= 0 {
+			passive.MaxFails = 1
+		}
+
+		if passive.FailDuration <= 0 {
+			passive.FailDuration = caddy.Duration(30 * time.Second)
+		}
+	}
+
+	if s.HealthChecks != nil && s.HealthChecks.Active != nil {
+		active := s.HealthChecks.Active
+
+		if active.Path == "" {
+			return errors.Errorf("Service %s active health checks need a path", s.name)
+		}
+
+		if active.Interval <= 0 {
+			active.Interval = caddy.Duration(30 * time.Second)
+		}
+
+		if active.Timeout <= 0 {
+			active.Timeout = caddy.Duration(5 * time.Second)
+		}
+	}
+
+	return nil
+}
+
+// selectUpstream picks one of the healthy upstreams of the service
+// according to the configured selection policy.
+func (s *Service) selectUpstream() (*upstream, error) {
+	available := make([]*upstream, 0, len(s.upstreams))
+
+	for _, candidate := range s.upstreams {
+		if candidate.healthy() {
+			available = append(available, candidate)
+		}
+	}
+
+	if len(available) == 0 {
+		return nil, errors.Errorf("Service %s has no healthy upstreams", s.name)
+	}
+
+	switch s.LoadBalancing.SelectionPolicy {
+	case LeastConnectionsPolicy:
+		var result *upstream
+		for _, candidate := range available {
+			if result == nil || atomic.LoadInt64(&candidate.inFlight) < atomic.LoadInt64(&result.inFlight) {
+				result = candidate
+			}
+		}
+		return result, nil
+	case RandomPolicy:
+		return available[rand.Intn(len(available))], nil
+	default:
+		next := atomic.AddUint32(&s.counter, 1)
+		return available[int(next-1)%len(available)], nil
+	}
+}
+
+// recordResult feeds the passive health checks with the outcome of a
+// request sent to the upstream.
+func (s *Service) recordResult(selected *upstream, statusCode int, err error) {
+	if s.HealthChecks == nil || s.HealthChecks.Passive == nil {
+		return
+	}
+
+	passive := s.HealthChecks.Passive
+
+	if err == nil && !passive.isUnhealthyStatus(statusCode) {
+		atomic.StoreInt64(&selected.fails, 0)
+		return
+	}
+
+	fails := atomic.AddInt64(&selected.fails, 1)
+
+	if fails >= int64(passive.MaxFails) {
+		until := time.Now().Add(time.Duration(passive.FailDuration))
+		atomic.StoreInt64(&selected.unhealthyUntil, until.UnixNano())
+		atomic.StoreInt64(&selected.fails, 0)
+	}
+}
+
+func (p *PassiveHealthChecks) isUnhealthyStatus(statusCode int) bool {
+	if len(p.UnhealthyStatus) == 0 {
+		return statusCode >= 500
+	}
+
+	for _, status := range p.UnhealthyStatus {
+		if status == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// startHealthChecks runs the active health checks of the service until
+// the module context is cancelled.
+func (s *Service) startHealthChecks(ctx caddy.Context, logger *zap.Logger) {
+	if s.HealthChecks == nil || s.HealthChecks.Active == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.HealthChecks.Active.Interval))
+		defer ticker.Stop()
+
+		s.checkUpstreams(ctx, logger)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.checkUpstreams(ctx, logger)
+			}
+		}
+	}()
+}
+
+func (s *Service) checkUpstreams(ctx context.Context, logger *zap.Logger) {
+	active := s.HealthChecks.Active
+	client := new(http.Client)
+
+	for _, target := range s.upstreams {
+		err := active.check(ctx, client, s, target)
+
+		if err != nil {
+			if atomic.SwapInt32(&target.activeHealthy, 0) == 1 {
+				logger.Warn(
+					"service upstream unhealthy",
+					zap.String("service", s.name),
+					zap.String("upstream", target.baseUrl.String()),
+					zap.Error(err),
+				)
+			}
+		} else {
+			if atomic.SwapInt32(&target.activeHealthy, 1) == 0 {
+				logger.Info(
+					"service upstream healthy",
+					zap.String("service", s.name),
+					zap.String("upstream", target.baseUrl.String()),
+				)
+			}
+		}
+	}
+}
+
+func (a *ActiveHealthChecks) check(ctx context.Context, client *http.Client, service *Service, target *upstream) error {
+	checkContext, cancel := context.WithTimeout(ctx, time.Duration(a.Timeout))
+	defer cancel()
+
+	checkUrl := service.resolveWith(target.baseUrl, &url.URL{Path: a.Path})
+	request, err := http.NewRequestWithContext(checkContext, http.MethodGet, checkUrl, nil)
+
+	if err != nil {
+		return err
+	}
+
+	service.applyAuth(request.Header)
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+
+	if a.ExpectStatus != 0 && response.StatusCode != a.ExpectStatus {
+		return errors.Errorf("Unexpected health check status %d", response.StatusCode)
+	}
+
+	if a.ExpectStatus == 0 && (response.StatusCode < 200 || response.StatusCode > 299) {
+		return errors.Errorf("Unexpected health check status %d", response.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package module
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Warmup loads components into the global cache in background, after the
+// handler is provisioned and periodically before they expire.
+type Warmup struct {
+	// Components to load.
+	Sources []*WarmupSource `json:"sources,omitempty"`
+
+	// Pages whose placeholders are loaded. They are fetched like the
+	// components, so they must be allowed by the upstream policy.
+	Pages []string `json:"pages,omitempty"`
+
+	// Maximum number of components loaded at the same time, 4 when zero.
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// Time between two warm-ups, loading the components expiring before
+	// the next one. Only at provision time when zero.
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+type WarmupSource struct {
+	// Method of the request, get when empty.
+	Method string `json:"method,omitempty"`
+
+	Url string `json:"url,omitempty"`
+
+	Body string `json:"body,omitempty"`
+}
+
+type warmupTarget struct {
+	method *string
+	url    *string
+	body   *string
+}
+
+func (u *Warmup) provision() error {
+	if u.Concurrency <= 0 {
+		u.Concurrency = 4
+	}
+
+	if u.Interval < 0 {
+		return errors.New("warmup interval must not be negative")
+	}
+
+	for _, source := range u.Sources {
+		if source.Url == "" {
+			return errors.New("warmup source without url")
+		}
+
+		if source.Method == "" {
+			source.Method = GET
+		}
+	}
+
+	return nil
+}
+
+// startWarmup runs the warm-ups until the module context is cancelled.
+func (w *WebComposer) startWarmup(ctx caddy.Context) {
+	if w.Warmup == nil {
+		return
+	}
+
+	go func() {
+		w.warmup(ctx)
+
+		if w.Warmup.Interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(time.Duration(w.Warmup.Interval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				w.warmup(ctx)
+			}
+		}
+	}()
+}
+
+// warmup loads the configured components and the placeholders of the
+// configured pages, following the placeholders of the loaded components.
+func (w *WebComposer) warmup(ctx context.Context) {
+	started := time.Now()
+	visited := make(map[string]struct{})
+	targets := w.warmupTargets(ctx)
+	loaded := 0
+
+	for len(targets) > 0 && ctx.Err() == nil {
+		var next []warmupTarget
+		var mutex sync.Mutex
+		var group sync.WaitGroup
+		slots := make(chan struct{}, w.Warmup.Concurrency)
+
+		for _, target := range targets {
+			key := *target.method + "\n" + *target.url + "\n" + stringOrEmpty(target.body)
+
+			if _, found := visited[key]; found {
+				continue
+			}
+
+			visited[key] = struct{}{}
+			slots <- struct{}{}
+			group.Add(1)
+
+			go func(target warmupTarget) {
+				defer group.Done()
+				defer func() { <-slots }()
+
+				source, refreshed, err := w.warmSource(ctx, target)
+
+				if err != nil {
+					w.logger.Warn(
+						"warmup error",
+						zap.String("component.url", *target.url),
+						zap.String("component.method", *target.method),
+						zap.Error(err),
+					)
+					return
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				if refreshed {
+					loaded++
+				}
+
+				next = append(next, placeholders(source.responseContent)...)
+			}(target)
+		}
+
+		group.Wait()
+		targets = next
+	}
+
+	w.logger.Info(
+		"warmup finished",
+		zap.Int("loaded", loaded),
+		zap.Int("components", len(visited)),
+		zap.Duration("duration", time.Since(started)),
+	)
+}
+
+func (w *WebComposer) warmupTargets(ctx context.Context) []warmupTarget {
+	var result []warmupTarget
+
+	for _, source := range w.Warmup.Sources {
+		target := warmupTarget{method: &source.Method, url: &source.Url}
+
+		if source.Body != "" {
+			target.body = &source.Body
+		}
+
+		result = append(result, target)
+	}
+
+	for _, page := range w.Warmup.Pages {
+		pageUrl := page
+		method := GET
+		source := newSource(&method, &pageUrl, nil)
+		err := w.loadInBackground(ctx, source)
+
+		if err == nil {
+			err = sourceStatusError(source)
+		}
+
+		if err != nil {
+			w.logger.Warn("warmup page error", zap.String("page.url", page), zap.Error(err))
+			continue
+		}
+
+		result = append(result, placeholders(source.responseContent)...)
+	}
+
+	return result
+}
+
+// warmSource loads the component unless the global cache keeps it past the
+// next warm-up, reporting whether it was loaded.
+func (w *WebComposer) warmSource(ctx context.Context, target warmupTarget) (*WebSource, bool, error) {
+	service, err := w.findService(target.url)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	source := newSource(target.method, target.url, target.body)
+	source.service = service
+
+	err = w.UpstreamPolicy.checkSource(source)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	composeContext, err := w.createBackgroundContext(ctx)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer composeContext.close()
+
+	composeContext.applyCacheKey(source)
+	cached := w.cache.entry(*source.id)
+	horizon := time.Now().Add(time.Duration(w.Warmup.Interval))
+
+	if cached != nil && cached.validUntil != nil && cached.validUntil.After(horizon) {
+		return cached.source, false, nil
+	}
+
+	err = source.load(*composeContext)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if w.cache.learnVary(*source.baseId, varyNames(source.responseHeaders)) {
+		composeContext.applyCacheKey(source)
+	}
+
+	composeContext.storeSource(source)
+
+	return source, true, sourceStatusError(source)
+}
+
+func (w *WebComposer) loadInBackground(ctx context.Context, source *WebSource) error {
+	service, err := w.findService(source.url)
+
+	if err != nil {
+		return err
+	}
+
+	source.service = service
+	err = w.UpstreamPolicy.checkSource(source)
+
+	if err != nil {
+		return err
+	}
+
+	composeContext, err := w.createBackgroundContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer composeContext.close()
+
+	return source.load(*composeContext)
+}
+
+// placeholders returns the components the content refers to.
+func placeholders(content *string) []warmupTarget {
+	if content == nil || !strings.Contains(strings.ToLower(*content), AttributeUrlKey) {
+		return nil
+	}
+
+	doc, err := parseString(content)
+
+	if err != nil {
+		return nil
+	}
+
+	var result []warmupTarget
+	defaultMethod := GET
+
+	for _, div := range divSelector.MatchAll(doc) {
+		target := placeholderTarget(div, &defaultMethod)
+
+		if target != nil {
+			result = append(result, *target)
+		}
+	}
+
+	return result
+}
+
+func placeholderTarget(div *html.Node, defaultMethod *string) *warmupTarget {
+	url := attr(div, AttributeUrlKey, nil)
+
+	if url == nil || attr(div, AttributeNameKey, nil) == nil {
+		return nil
+	}
+
+	return &warmupTarget{
+		method: attr(div, AttributeMethodKey, defaultMethod),
+		url:    url,
+		body:   attr(div, AttributeBodyKey, nil),
+	}
+}